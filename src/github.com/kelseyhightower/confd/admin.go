@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/confd/backends"
+	"github.com/kelseyhightower/confd/log"
+	"github.com/kelseyhightower/confd/resource/template"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// healthProbeTimeout bounds the backend health check made by /health.
+var healthProbeTimeout = 5 * time.Second
+
+// healthStatus is the response of the admin /health endpoint.
+type healthStatus struct {
+	Healthy              bool      `json:"healthy"`
+	Backend              string    `json:"backend"`
+	BackendReachable     bool      `json:"backend_reachable"`
+	BackendErrors        []string  `json:"backend_errors,omitempty"`
+	LastSuccessfulRender time.Time `json:"last_successful_render"`
+}
+
+// adminServer serves health, status and trigger endpoints and, optionally,
+// metrics and profiling endpoints.
+type adminServer struct {
+	backend     string
+	storeClient backends.StoreClient
+	processor   template.Processor
+	mux         *http.ServeMux
+}
+
+func newAdminServer(backend string, storeClient backends.StoreClient, processor template.Processor, metricsPath string, enablePprof bool) *adminServer {
+	s := &adminServer{
+		backend:     backend,
+		storeClient: storeClient,
+		processor:   processor,
+		mux:         http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/health", s.health)
+	s.mux.HandleFunc("/status", s.status)
+	s.mux.HandleFunc("/trigger", s.trigger)
+	if metricsPath != "" {
+		s.mux.Handle(metricsPath, promhttp.Handler())
+	}
+	if enablePprof {
+		s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+		s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return s
+}
+
+// listenAdmin listens on addr, which is either a TCP address or the path of
+// a unix socket prefixed with "unix:".
+func listenAdmin(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		// Remove a socket left behind by a previous run.
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serve serves admin requests on l until it is closed.
+func (s *adminServer) serve(l net.Listener) {
+	log.Info("Admin server listening on " + l.Addr().String())
+	if err := http.Serve(l, s.mux); err != nil {
+		log.Error("Admin server stopped: " + err.Error())
+	}
+}
+
+func (s *adminServer) health(w http.ResponseWriter, r *http.Request) {
+	h := healthStatus{Backend: s.backend, BackendReachable: true}
+	ctx, cancel := context.WithTimeout(r.Context(), healthProbeTimeout)
+	defer cancel()
+	if err := s.storeClient.Health(ctx); err != nil {
+		h.BackendReachable = false
+		h.BackendErrors = append(h.BackendErrors, err.Error())
+	}
+	for _, status := range s.processor.Status() {
+		if status.BackendError != "" {
+			h.BackendReachable = false
+			h.BackendErrors = append(h.BackendErrors, status.Name+": "+status.BackendError)
+		}
+		if status.LastRender.After(h.LastSuccessfulRender) {
+			h.LastSuccessfulRender = status.LastRender
+		}
+	}
+	h.Healthy = h.BackendReachable
+	code := http.StatusOK
+	if !h.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, h)
+}
+
+func (s *adminServer) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.processor.Status())
+}
+
+// trigger processes the template resource named by the resource parameter,
+// or all of them if it is not set.
+func (s *adminServer) trigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("resource")
+	results, err := s.processor.Trigger(name)
+	if err == template.ErrUnknownResource {
+		http.Error(w, "unknown template resource "+name, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Error("Cannot encode admin response: " + err.Error())
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+	"github.com/kelseyhightower/confd/resource/template"
+)
+
+type fakeProcessor struct {
+	statuses  []template.ResourceStatus
+	triggered []string
+}
+
+func (p *fakeProcessor) Process() {}
+
+func (p *fakeProcessor) Trigger(name string) ([]template.TriggerResult, error) {
+	if name == "missing" {
+		return nil, template.ErrUnknownResource
+	}
+	p.triggered = append(p.triggered, name)
+	return []template.TriggerResult{{Name: "nginx", Outcome: template.OutcomeUpdated}}, nil
+}
+
+func (p *fakeProcessor) Reload(config template.Config) error {
+	return nil
+}
+
+func (p *fakeProcessor) RemoveStageFiles() {}
+
+func (p *fakeProcessor) Status() []template.ResourceStatus {
+	return p.statuses
+}
+
+// fakeStoreClient is a backend whose health check returns health.
+type fakeStoreClient struct {
+	health error
+}
+
+func (c *fakeStoreClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (c *fakeStoreClient) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
+	<-ctx.Done()
+	return waitIndex, ctx.Err()
+}
+
+func (c *fakeStoreClient) Health(ctx context.Context) error {
+	return c.health
+}
+
+func (c *fakeStoreClient) Close() error {
+	return nil
+}
+
+func TestAdminHealth(t *testing.T) {
+	log.SetLevel("warn")
+	rendered := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		statuses  []template.ResourceStatus
+		health    error
+		code      int
+		reachable bool
+	}{
+		{[]template.ResourceStatus{{Name: "a", LastRender: rendered}}, nil, http.StatusOK, true},
+		{[]template.ResourceStatus{{Name: "a", LastRender: rendered}, {Name: "b", BackendError: "timeout"}}, nil, http.StatusServiceUnavailable, false},
+		{[]template.ResourceStatus{{Name: "a", LastRender: rendered}}, errors.New("no leader"), http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		s := newAdminServer("etcd", &fakeStoreClient{tt.health}, &fakeProcessor{statuses: tt.statuses}, "", false)
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		if w.Code != tt.code {
+			t.Errorf("GET /health = %d, want %d", w.Code, tt.code)
+		}
+		var h healthStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+			t.Fatal(err.Error())
+		}
+		if h.BackendReachable != tt.reachable {
+			t.Errorf("backend_reachable = %v, want %v", h.BackendReachable, tt.reachable)
+		}
+		if !h.LastSuccessfulRender.Equal(rendered) {
+			t.Errorf("last_successful_render = %v, want %v", h.LastSuccessfulRender, rendered)
+		}
+	}
+}
+
+func TestAdminStatusAndPprof(t *testing.T) {
+	log.SetLevel("warn")
+	p := &fakeProcessor{statuses: []template.ResourceStatus{{Name: "nginx", Dest: "/etc/nginx/nginx.conf", ReloadExitCode: 1}}}
+	s := newAdminServer("etcd", &fakeStoreClient{}, p, "/metrics", false)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var statuses []template.ResourceStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(statuses) != 1 || statuses[0].Name != "nginx" || statuses[0].ReloadExitCode != 1 {
+		t.Errorf("GET /status = %v, want %v", statuses, p.statuses)
+	}
+
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "# TYPE go_goroutines gauge") {
+		t.Errorf("GET /metrics = %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected pprof to be disabled, got %d", w.Code)
+	}
+	s = newAdminServer("etcd", &fakeStoreClient{}, p, "", true)
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected pprof to be enabled, got %d", w.Code)
+	}
+}
+
+func TestAdminTrigger(t *testing.T) {
+	log.SetLevel("warn")
+	p := &fakeProcessor{}
+	s := newAdminServer("etcd", &fakeStoreClient{}, p, "", false)
+	tests := []struct {
+		method, url string
+		code        int
+	}{
+		{"GET", "/trigger", http.StatusMethodNotAllowed},
+		{"POST", "/trigger", http.StatusOK},
+		{"POST", "/trigger?resource=nginx", http.StatusOK},
+		{"POST", "/trigger?resource=missing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.url, w.Code, tt.code)
+		}
+	}
+	if !reflect.DeepEqual(p.triggered, []string{"", "nginx"}) {
+		t.Errorf("Triggered %q, want all and nginx", p.triggered)
+	}
+}
@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"errors"
 	"strings"
 
@@ -17,8 +18,32 @@ import (
 // The StoreClient interface is implemented by objects that can retrieve
 // key/value pairs from a backend store.
 type StoreClient interface {
-	GetValues(keys []string) (map[string]string, error)
-	WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error)
+	// GetValues returns the values of keys, and of the keys below them
+	// where the backend supports it.
+	GetValues(ctx context.Context, keys []string) (map[string]string, error)
+	// WatchPrefix blocks until a key below prefix changes after waitIndex
+	// and returns the index to wait from next. It returns ctx.Err() if ctx
+	// is done first.
+	WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error)
+	// Health returns an error if the backend cannot be reached.
+	Health(ctx context.Context) error
+	// Close releases the connections held by the client.
+	Close() error
+}
+
+// PrefixDeletedError is implemented by the errors WatchPrefix returns when
+// the watched prefix was deleted from the backend, rather than when the
+// watch failed. Backends implement it without importing this package.
+type PrefixDeletedError interface {
+	error
+	PrefixDeleted() bool
+}
+
+// IsPrefixDeleted reports whether err means that the watched prefix was
+// deleted from the backend.
+func IsPrefixDeleted(err error) bool {
+	e, ok := err.(PrefixDeletedError)
+	return ok && e.PrefixDeleted()
 }
 
 // New is used to create a storage client based on our configuration.
@@ -44,7 +69,10 @@ func New(config Config) (StoreClient, error) {
 	case "env":
 		return env.NewEnvClient()
 	case "config-service":
-		return config_service.NewConfigClient(backendNodes)
+		if config.CacheDir != "" {
+			log.Info("Config-service bucket cache set to " + config.CacheDir)
+		}
+		return config_service.NewConfigClient(backendNodes, config.CacheDir)
 	case "dynamodb":
 		table := config.Table
 		log.Info("DynamoDB table set to " + table)
@@ -0,0 +1,25 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kelseyhightower/confd/backends/config-service"
+)
+
+func TestIsPrefixDeleted(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("connection refused"), false},
+		{context.Canceled, false},
+		{&config_service.BucketDeletedError{Bucket: "app"}, true},
+	} {
+		if got := IsPrefixDeleted(c.err); got != c.want {
+			t.Errorf("IsPrefixDeleted(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package config_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cfgsvc "github.com/Flipkart/config-service/client-go"
+)
+
+// watchStaleAfter is how long the watch of a bucket may go without an
+// answer from config-service before it is reported as disconnected. Watch
+// requests time out after a minute, so a live watch is answered at least
+// that often.
+var watchStaleAfter = 2 * time.Minute
+
+var errClosed = errors.New("config-service client is closed")
+
+// liveBucket is a bucket kept up to date by a watch on config-service. Its
+// listeners are told about every change.
+type liveBucket interface {
+	bucket
+	AddListeners(listener cfgsvc.BucketUpdatesListener)
+	RemoveListeners(listener cfgsvc.BucketUpdatesListener)
+}
+
+// bucketSource serves the dynamic buckets of the config-service client and
+// tracks whether their watches are connected.
+type bucketSource struct {
+	client *cfgsvc.ConfigServiceClient
+	// mutex guards listeners, the connection state of the watch of every
+	// bucket fetched so far, and closed.
+	mutex     sync.Mutex
+	listeners map[string]*connectionListener
+	closed    bool
+}
+
+func newBucketSource(client *cfgsvc.ConfigServiceClient) *bucketSource {
+	return &bucketSource{client: client, listeners: make(map[string]*connectionListener)}
+}
+
+// getBucket returns the named bucket, which is watched from then on.
+func (s *bucketSource) getBucket(name string) (liveBucket, error) {
+	if s.isClosed() {
+		return nil, errClosed
+	}
+	b, err := s.client.GetDynamicBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, errClosed
+	}
+	if l, ok := s.listeners[name]; ok && l.bucket == b {
+		s.mutex.Unlock()
+		return b, nil
+	}
+	// The bucket is new, or replaces one that was deleted or evicted from
+	// the cache of the client along with its watch.
+	l := newConnectionListener(s, name, b)
+	s.listeners[name] = l
+	s.mutex.Unlock()
+	// The bucket calls its listeners with its lock held, so it must not be
+	// called with s.mutex held.
+	b.AddListeners(l)
+	return b, nil
+}
+
+// drop stops tracking the watch of l, unless it was replaced already.
+func (s *bucketSource) drop(l *connectionListener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.listeners[l.name] == l {
+		delete(s.listeners, l.name)
+	}
+}
+
+// health reports the buckets whose watch lost config-service.
+func (s *bucketSource) health(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var disconnected []string
+	for name, l := range s.listeners {
+		if err := l.err(); err != nil {
+			disconnected = append(disconnected, name+": "+err.Error())
+		}
+	}
+	if len(disconnected) > 0 {
+		sort.Strings(disconnected)
+		return fmt.Errorf("watches disconnected from config-service: %s", strings.Join(disconnected, ", "))
+	}
+	return nil
+}
+
+// isClosed reports whether s was closed.
+func (s *bucketSource) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// close stops serving and tracking the buckets. The config-service client
+// offers no way to stop its watches, which keep running in the background
+// without listeners.
+func (s *bucketSource) close() {
+	s.mutex.Lock()
+	listeners := s.listeners
+	s.listeners = make(map[string]*connectionListener)
+	s.closed = true
+	s.mutex.Unlock()
+	for _, l := range listeners {
+		l.bucket.RemoveListeners(l)
+	}
+}
+
+// connectionListener records whether the watch of a bucket is connected to
+// config-service.
+type connectionListener struct {
+	source *bucketSource
+	name   string
+	bucket liveBucket
+
+	mutex     sync.Mutex
+	connected bool
+	lastErr   error
+	// lastSeen is when config-service last answered the watch.
+	lastSeen time.Time
+}
+
+func newConnectionListener(source *bucketSource, name string, bucket liveBucket) *connectionListener {
+	return &connectionListener{source: source, name: name, bucket: bucket, connected: true, lastSeen: time.Now()}
+}
+
+func (l *connectionListener) Connected(bucketName string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.connected, l.lastErr, l.lastSeen = true, nil, time.Now()
+}
+
+func (l *connectionListener) Disconnected(bucketName string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if isNotModified(err) {
+		// The watch timed out without a change: config-service answered.
+		l.connected, l.lastErr, l.lastSeen = true, nil, time.Now()
+		return
+	}
+	l.connected, l.lastErr = false, err
+}
+
+// Deleted drops the watch of the bucket, which stops along with it.
+func (l *connectionListener) Deleted(bucketName string) {
+	l.source.drop(l)
+}
+
+func (l *connectionListener) Updated(oldBucket *cfgsvc.Bucket, newBucket *cfgsvc.Bucket) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lastSeen = time.Now()
+}
+
+// err returns the error the watch was disconnected with, or nil if it is
+// connected.
+func (l *connectionListener) err() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.connected {
+		if l.lastErr == nil {
+			return errors.New("disconnected")
+		}
+		return l.lastErr
+	}
+	// Once a watch times out the config-service client reports no error
+	// until config-service answers again, so a watch left unanswered is
+	// disconnected too.
+	if since := time.Since(l.lastSeen); since > watchStaleAfter {
+		return fmt.Errorf("no answer for %s", since/time.Second*time.Second)
+	}
+	return nil
+}
+
+// isNotModified reports whether err is the answer of config-service to a
+// watch that timed out without a change.
+func isNotModified(err error) bool {
+	e, ok := err.(*cfgsvc.ErrorResp)
+	return ok && e.ErrorType == cfgsvc.NOT_MODIFIED
+}
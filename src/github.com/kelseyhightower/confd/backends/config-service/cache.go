@@ -0,0 +1,115 @@
+package config_service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// bucket is the read-only view of a config-service bucket used to render
+// templates. It is satisfied by live dynamic buckets and by cached copies.
+type bucket interface {
+	GetName() string
+	GetVersion() uint
+	GetKeys() map[string]interface{}
+}
+
+// cachedBucket is a bucket snapshot as persisted in the cache directory.
+type cachedBucket struct {
+	Name    string                 `json:"name"`
+	Version uint                   `json:"version"`
+	Keys    map[string]interface{} `json:"keys"`
+}
+
+func (b *cachedBucket) GetName() string {
+	return b.Name
+}
+
+func (b *cachedBucket) GetVersion() uint {
+	return b.Version
+}
+
+func (b *cachedBucket) GetKeys() map[string]interface{} {
+	return b.Keys
+}
+
+// bucketCache persists fetched buckets on disk so that confd can start from
+// the last known values when config-service is unreachable.
+type bucketCache struct {
+	dir      string
+	mutex    sync.Mutex
+	versions map[string]uint
+}
+
+func newBucketCache(dir string) (*bucketCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &bucketCache{dir: dir, versions: make(map[string]uint)}, nil
+}
+
+func (c *bucketCache) path(name string) string {
+	return filepath.Join(c.dir, name+".json")
+}
+
+// store writes b to the cache unless the same version was already written.
+// The file is replaced atomically so a crash never leaves a partial bucket.
+func (c *bucketCache) store(b bucket) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	name := b.GetName()
+	if v, ok := c.versions[name]; ok && v == b.GetVersion() {
+		return nil
+	}
+	data, err := json.Marshal(&cachedBucket{Name: name, Version: b.GetVersion(), Keys: b.GetKeys()})
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(c.dir, "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), c.path(name)); err != nil {
+		return err
+	}
+	c.versions[name] = b.GetVersion()
+	return nil
+}
+
+// load returns the cached copy of the named bucket.
+func (c *bucketCache) load(name string) (*cachedBucket, error) {
+	data, err := ioutil.ReadFile(c.path(name))
+	if err != nil {
+		return nil, err
+	}
+	b := &cachedBucket{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	if b.Name == "" {
+		b.Name = name
+	}
+	return b, nil
+}
+
+// remove drops the cached copy of the named bucket.
+func (c *bucketCache) remove(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.versions, name)
+	err := os.Remove(c.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package config_service
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBucketCacheStoreLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	cache, err := newBucketCache(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := &cachedBucket{Name: "foo", Version: 3, Keys: map[string]interface{}{"bar": "baz", "n": 1.5}}
+	if err := cache.store(want); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := cache.load("foo")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("load(foo) = %v, want %v", got, want)
+	}
+	if err := cache.remove("foo"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := cache.load("foo"); !os.IsNotExist(err) {
+		t.Errorf("Expected cached bucket to be removed, got %v", err)
+	}
+}
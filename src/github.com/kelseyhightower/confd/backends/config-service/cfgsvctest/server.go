@@ -0,0 +1,245 @@
+// Package cfgsvctest provides an in-process config-service for tests.
+//
+// The server speaks the subset of the config-service HTTP API used by the
+// config-service client: fetching a bucket and long-polling watches on it.
+// Tests create, update and delete buckets on the server. The config-service
+// client only talks to the endpoint derived from the instance metadata, so
+// the latest Server started receives the bucket requests sent through
+// http.DefaultTransport, whatever their host, until it is closed.
+package cfgsvctest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bucketPath = "/v1/buckets/"
+
+type bucket struct {
+	Meta bucketMeta             `json:"metadata"`
+	Keys map[string]interface{} `json:"keys"`
+}
+
+type bucketMeta struct {
+	Name        string `json:"name"`
+	Version     uint   `json:"version"`
+	LastUpdated uint64 `json:"lastUpdated"`
+}
+
+type errorResp struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// Server is a fake config-service listening on a local port.
+type Server struct {
+	// URL is the base URL of the server.
+	URL string
+
+	server       *httptest.Server
+	mutex        sync.Mutex
+	buckets      map[string]*bucket
+	versions     map[string]uint
+	changed      chan struct{}
+	done         chan struct{}
+	unavailable  bool
+	watchTimeout time.Duration
+}
+
+// NewServer starts and returns a new Server with no buckets.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		buckets:      make(map[string]*bucket),
+		versions:     make(map[string]uint),
+		changed:      make(chan struct{}),
+		done:         make(chan struct{}),
+		watchTimeout: 30 * time.Second,
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	route(s)
+	return s
+}
+
+// Close releases pending watches and shuts down the server.
+func (s *Server) Close() {
+	unroute(s)
+	close(s.done)
+	s.server.Close()
+}
+
+var (
+	installRoute sync.Once
+	routeMutex   sync.Mutex
+	// routed is the Server receiving the bucket requests, if any.
+	routed *Server
+)
+
+// route sends the bucket requests to s from now on.
+func route(s *Server) {
+	installRoute.Do(func() {
+		http.DefaultTransport = &routeTransport{next: http.DefaultTransport}
+	})
+	routeMutex.Lock()
+	defer routeMutex.Unlock()
+	routed = s
+}
+
+// unroute stops sending the bucket requests to s.
+func unroute(s *Server) {
+	routeMutex.Lock()
+	defer routeMutex.Unlock()
+	if routed == s {
+		routed = nil
+	}
+}
+
+// routeTransport sends the bucket requests to the routed Server, failing
+// them if there is none, and the other requests to next.
+type routeTransport struct {
+	next http.RoundTripper
+}
+
+func (t *routeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(r.URL.Path, bucketPath) {
+		return t.next.RoundTrip(r)
+	}
+	routeMutex.Lock()
+	s := routed
+	routeMutex.Unlock()
+	if s == nil {
+		return nil, errors.New("cfgsvctest: no server is running")
+	}
+	u := *r.URL
+	u.Scheme, u.Host = "http", s.server.Listener.Addr().String()
+	routedReq := r.WithContext(r.Context())
+	routedReq.URL, routedReq.Host = &u, ""
+	return t.next.RoundTrip(routedReq)
+}
+
+// SetBucket creates the named bucket or replaces its keys, notifying any
+// watchers. It returns the new version of the bucket.
+func (s *Server) SetBucket(name string, keys map[string]interface{}) uint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Versions keep increasing across deletes so watchers never mistake a
+	// recreated bucket for the one they already have.
+	s.versions[name]++
+	copied := make(map[string]interface{}, len(keys))
+	for k, v := range keys {
+		copied[k] = v
+	}
+	s.buckets[name] = &bucket{
+		Meta: bucketMeta{Name: name, Version: s.versions[name], LastUpdated: uint64(time.Now().Unix())},
+		Keys: copied,
+	}
+	s.notify()
+	return s.versions[name]
+}
+
+// DeleteBucket deletes the named bucket, notifying any watchers.
+func (s *Server) DeleteBucket(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.buckets, name)
+	s.notify()
+}
+
+// SetAvailable controls whether the server answers requests. While
+// unavailable every request, including pending watches, fails with 503.
+func (s *Server) SetAvailable(available bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unavailable = !available
+	s.notify()
+}
+
+// SetWatchTimeout sets how long a watch waits for a change before the server
+// answers that the bucket was not modified.
+func (s *Server) SetWatchTimeout(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.watchTimeout = d
+}
+
+// notify wakes up all pending watches. s.mutex must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !strings.HasPrefix(r.URL.Path, bucketPath) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, bucketPath)
+	if r.URL.Query().Get("watch") != "true" {
+		s.get(w, name)
+		return
+	}
+	version, _ := strconv.ParseUint(r.Header.Get("X-Config-Bucket-Version"), 10, 64)
+	s.watch(w, name, uint(version))
+}
+
+func (s *Server) get(w http.ResponseWriter, name string) {
+	s.mutex.Lock()
+	b, ok := s.buckets[name]
+	unavailable := s.unavailable
+	s.mutex.Unlock()
+	switch {
+	case unavailable:
+		writeJSON(w, http.StatusServiceUnavailable, &errorResp{"UNAVAILABLE", "config-service is unavailable"})
+	case !ok:
+		writeJSON(w, http.StatusNotFound, &errorResp{"NOT_FOUND", "bucket " + name + " not found"})
+	default:
+		writeJSON(w, http.StatusOK, b)
+	}
+}
+
+// watch blocks until the named bucket no longer has the given version.
+func (s *Server) watch(w http.ResponseWriter, name string, version uint) {
+	s.mutex.Lock()
+	timeout := time.After(s.watchTimeout)
+	s.mutex.Unlock()
+	for {
+		s.mutex.Lock()
+		b, ok := s.buckets[name]
+		unavailable := s.unavailable
+		changed := s.changed
+		s.mutex.Unlock()
+		switch {
+		case unavailable:
+			writeJSON(w, http.StatusServiceUnavailable, &errorResp{"UNAVAILABLE", "config-service is unavailable"})
+			return
+		case !ok:
+			writeJSON(w, http.StatusNotFound, &errorResp{"DELETED", "bucket " + name + " was deleted"})
+			return
+		case b.Meta.Version != version:
+			writeJSON(w, http.StatusOK, b)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			writeJSON(w, http.StatusOK, &errorResp{"NOT_MODIFIED", "bucket " + name + " not modified"})
+			return
+		case <-s.done:
+			writeJSON(w, http.StatusServiceUnavailable, &errorResp{"UNAVAILABLE", "config-service is shutting down"})
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
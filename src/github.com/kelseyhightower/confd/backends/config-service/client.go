@@ -1,166 +1,347 @@
 package config_service
 
 import (
+	"context"
 	"strings"
 	cfgsvc "github.com/Flipkart/config-service/client-go"
 	"github.com/kelseyhightower/confd/log"
-	"errors"
+	"fmt"
 	"reflect"
 	"github.com/pquerna/ffjson/ffjson"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// reconnectInterval is how often buckets served from the cache are
+// retried against config-service.
+var reconnectInterval = 10 * time.Second
+
 // Client provides a wrapper around the zookeeper client
 type Client struct {
-	client *cfgsvc.ConfigServiceClient
+	source *bucketSource
+	cache  *bucketCache
+	mutex  sync.Mutex
+	// offline holds the buckets currently served from the cache.
+	offline map[string]bool
 }
 
 type BucketListener struct{
+	client *Client
 	watchResp chan *watchResponse
 	currentIndex uint64
 }
 
+// BucketDeletedError is returned by WatchPrefix when one of the watched
+// buckets is deleted from config-service.
+type BucketDeletedError struct {
+	Bucket string
+}
+
+func (e *BucketDeletedError) Error() string {
+	return e.Bucket + " was deleted"
+}
+
+// PrefixDeleted implements backends.PrefixDeletedError.
+func (e *BucketDeletedError) PrefixDeleted() bool {
+	return true
+}
+
 type watchResponse struct {
 	waitIndex uint64
 	err       error
 }
 
 func (this *BucketListener) Connected(bucketName string) {
-	log.Info("Connected! " + bucketName)
+	log.Info("Watch on bucket " + bucketName + " connected to config-service")
 }
 
 func (this *BucketListener) Disconnected(bucketName string, err error) {
-	log.Info("Disconnected! " + bucketName)
+	if isNotModified(err) {
+		return
+	}
+	log.Warning(fmt.Sprintf("Watch on bucket %s disconnected from config-service: %v", bucketName, err))
 }
 
 func (this *BucketListener) Deleted(bucketName string) {
 	log.Info("deleted " + bucketName)
-	this.watchResp <- &watchResponse{waitIndex: 0, err: errors.New(bucketName + " was deleted")}
+	// Never serve a deleted bucket from the cache.
+	if this.client.cache != nil {
+		if err := this.client.cache.remove(bucketName); err != nil {
+			log.Error(fmt.Sprintf("Cannot remove cached bucket %s: %s", bucketName, err.Error()))
+		}
+	}
+	this.notify(&watchResponse{waitIndex: 0, err: &BucketDeletedError{Bucket: bucketName}})
 }
 
 func (this *BucketListener) Updated(oldBucket *cfgsvc.Bucket, newBucket *cfgsvc.Bucket) {
-	this.watchResp <- &watchResponse{waitIndex:this.currentIndex+1, err: nil}
+	this.client.storeInCache(newBucket)
+	this.notify(&watchResponse{waitIndex:this.currentIndex+1, err: nil})
+}
+
+// notify queues resp unless a response is already pending. The
+// config-service client calls listeners with the bucket locked, so they
+// must not block until the watch removes them.
+func (this *BucketListener) notify(resp *watchResponse) {
+	select {
+	case this.watchResp <- resp:
+	default:
+	}
 }
 
 
-func NewConfigClient(machines []string) (*Client, error) {
+// NewConfigClient returns a config-service client. machines are ignored:
+// the client talks to the endpoint derived from the instance metadata. When
+// cacheDir is not empty every fetched bucket is persisted there and used as
+// a fallback while config-service is unreachable.
+func NewConfigClient(machines []string, cacheDir string) (*Client, error) {
+	client := &Client{offline: make(map[string]bool)}
 	c, err := cfgsvc.NewConfigServiceClient(50) //*10)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &Client{c}, nil
+	client.source = newBucketSource(c)
+	if cacheDir != "" {
+		client.cache, err = newBucketCache(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
 }
 
 
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
+// GetValues returns the values of keys of the form /bucket1,bucket2/key,
+// where a key of "*" selects every key of the buckets. Buckets are resolved
+// once per call and a key present in several buckets takes its value from
+// the last one listed.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
 	vars := make(map[string]string)
+	snapshots := make(map[string]map[string]interface{})
 	for _, v := range keys {
+		if err := ctx.Err(); err != nil {
+			return vars, err
+		}
 		bucketsKey := strings.Split(strings.TrimPrefix(v, "/"), "/")
 		buckets := strings.Split(bucketsKey[0], ",")
 		key := bucketsKey[1]
 
-		dynamicBuckets, err := c.getDynamicBuckets(buckets)
-		if err != nil {
+		for i := range buckets {
+			buckets[i] = strings.TrimSpace(buckets[i])
+		}
+		if err := c.resolveSnapshots(buckets, snapshots); err != nil {
 			return vars, err
 		}
 
-
-		for _, dynamicBucket := range dynamicBuckets {
-			var requestedKeys []string
-
+		for _, bucketName := range buckets {
+			bucketKeys := snapshots[bucketName]
 			if key == "*" {
 				//when key is "*" get all keys in a bucket,
-				bucketKeys := dynamicBucket.GetKeys()
-				requestedKeys = []string{}
-				for k, _ := range bucketKeys {
-					requestedKeys = append(requestedKeys, k)
+				for k, val := range bucketKeys {
+					setValue(vars, k, val)
 				}
 			} else {
-				requestedKeys = []string{key}
+				setValue(vars, key, bucketKeys[key])
 			}
+		}
+	}
+	return vars, nil
+}
 
-			//For each key in bucket store value in variable named 'vars'
-			for _, k := range requestedKeys {
+// resolveSnapshots adds the keys of each of the named buckets missing from
+// snapshots, fetching all of them in a single pass.
+func (c *Client) resolveSnapshots(buckets []string, snapshots map[string]map[string]interface{}) error {
+	var missing []string
+	for _, bucketName := range buckets {
+		if _, ok := snapshots[bucketName]; !ok {
+			missing = append(missing, bucketName)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	resolved, _, err := c.getBuckets(missing)
+	if err != nil {
+		return err
+	}
+	for i, b := range resolved {
+		snapshots[missing[i]] = b.GetKeys()
+	}
+	return nil
+}
 
-				val := dynamicBucket.GetKeys()[k]
-				if val == nil {
-					continue
-				}
+// setValue stores the string representation of val in vars.
+func setValue(vars map[string]string, k string, val interface{}) {
+	if val == nil {
+		return
+	}
 
-				valType := reflect.TypeOf(val).Kind()
-				if valType == reflect.Slice {
-					data, err := ffjson.Marshal(val)
-					if err != nil {
-						log.Error("Failed decoding from JSON")
-					} else {
-						vars[k] = string(data[:])
-					}
-				} else {
-					switch val.(type) {
-					case int, int64:
-						vars[k] = strconv.FormatInt(val.(int64), 64)
-					case string:
-						vars[k] = val.(string)
-					case bool:
-						vars[k] = strconv.FormatBool(val.(bool))
-					case float32, float64:
-						vars[k] = strconv.FormatFloat(val.(float64), 'f', -1, 64)
-					}
-				}
-			}
+	valType := reflect.TypeOf(val).Kind()
+	if valType == reflect.Slice {
+		data, err := ffjson.Marshal(val)
+		if err != nil {
+			log.Error("Failed decoding from JSON")
+		} else {
+			vars[k] = string(data[:])
+		}
+	} else {
+		switch val.(type) {
+		case int, int64:
+			vars[k] = strconv.FormatInt(val.(int64), 64)
+		case string:
+			vars[k] = val.(string)
+		case bool:
+			vars[k] = strconv.FormatBool(val.(bool))
+		case float32, float64:
+			vars[k] = strconv.FormatFloat(val.(float64), 'f', -1, 64)
+		}
+	}
+}
+
+// getBuckets resolves the named buckets, falling back to the cached copy of
+// a bucket when it cannot be fetched from config-service. It reports whether
+// any of the returned buckets came from the cache.
+func (c *Client) getBuckets(buckets []string) ([]bucket, bool, error) {
+	var result []bucket
+	offline := false
+	for _, b := range buckets {
+		bucketName := strings.TrimSpace(b)
+		dynamicBucket, err := c.source.getBucket(bucketName)
+		if err == nil {
+			c.storeInCache(dynamicBucket)
+			c.setOffline(bucketName, false)
+			result = append(result, dynamicBucket)
+			continue
+		}
+		if c.cache == nil || err == errClosed {
+			return result, offline, err
+		}
+		cached, cerr := c.cache.load(bucketName)
+		if cerr != nil {
+			return result, offline, err
 		}
+		if c.setOffline(bucketName, true) {
+			log.Warning(fmt.Sprintf("Cannot fetch bucket %s from config-service, using cached version %d: %s",
+				bucketName, cached.GetVersion(), err.Error()))
+		}
+		result = append(result, cached)
+		offline = true
+	}
+	return result, offline, nil
+}
 
+// setOffline records whether bucketName is served from the cache and
+// reports whether that changed.
+func (c *Client) setOffline(bucketName string, offline bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.offline[bucketName] == offline {
+		return false
+	}
+	if offline {
+		c.offline[bucketName] = true
+	} else {
+		delete(c.offline, bucketName)
+		log.Info("Bucket " + bucketName + " is live again, switching from cached version")
+	}
+	return true
+}
+
+func (c *Client) storeInCache(b bucket) {
+	if c.cache == nil {
+		return
+	}
+	if err := c.cache.store(b); err != nil {
+		log.Error(fmt.Sprintf("Cannot cache bucket %s: %s", b.GetName(), err.Error()))
 	}
-	return vars, nil
 }
 
-func (c *Client) getDynamicBuckets(buckets []string) ([]*cfgsvc.DynamicBucket, error) {
-	var dynamicBuckets []*cfgsvc.DynamicBucket
-	for _, bucket := range buckets {
-		bucketName := strings.TrimSpace(bucket)
-		dynamicBucket, err := c.client.GetDynamicBucket(bucketName)
+// waitForConnectivity blocks while any of the named buckets can only be
+// served from the cache. Once all of them are fetched from config-service
+// again it returns a new index so the caller re-renders from live values.
+func (c *Client) waitForConnectivity(ctx context.Context, buckets []string, waitIndex uint64) (uint64, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(reconnectInterval):
+		}
+		_, offline, err := c.getBuckets(buckets)
 		if err != nil {
-			return dynamicBuckets, err
+			return waitIndex, err
+		}
+		if !offline {
+			return waitIndex + 1, nil
 		}
-		dynamicBuckets = append(dynamicBuckets, dynamicBucket)
 	}
-	return dynamicBuckets, nil
 }
 
-func setupDynamicBucketListeners(dynamicBuckets []*cfgsvc.DynamicBucket, bucketListener *BucketListener) {
-	for _, dynamicBucket := range dynamicBuckets {
-		dynamicBucket.AddListeners(bucketListener)
+func setupDynamicBucketListeners(buckets []bucket, bucketListener *BucketListener) {
+	for _, b := range buckets {
+		if dynamicBucket, ok := b.(liveBucket); ok {
+			dynamicBucket.AddListeners(bucketListener)
+		}
 	}
 }
 
-func removeDynamicBucketListeners(dynamicBuckets []*cfgsvc.DynamicBucket, bucketListener *BucketListener) {
-	for _, dynamicBucket := range dynamicBuckets {
-		dynamicBucket.RemoveListeners(bucketListener)
+func removeDynamicBucketListeners(buckets []bucket, bucketListener *BucketListener) {
+	for _, b := range buckets {
+		if dynamicBucket, ok := b.(liveBucket); ok {
+			dynamicBucket.RemoveListeners(bucketListener)
+		}
 	}
 }
 
-func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
 	prefix = strings.TrimPrefix(prefix, "/")
 	prefixes := strings.Split(prefix, ",")
-	dynamicBuckets, err := c.getDynamicBuckets(prefixes)
+	dynamicBuckets, offline, err := c.getBuckets(prefixes)
 	if err != nil {
 		return waitIndex, err
 	}
 
 	if waitIndex == 0 {
 		return waitIndex+1, nil
-	}  else {
+	} else if offline {
+		return c.waitForConnectivity(ctx, prefixes, waitIndex)
+	} else {
 		watchResp := make(chan *watchResponse, len(dynamicBuckets))
-		bucketListener := &BucketListener{watchResp: watchResp, currentIndex: waitIndex}
+		bucketListener := &BucketListener{client: c, watchResp: watchResp, currentIndex: waitIndex}
 		setupDynamicBucketListeners(dynamicBuckets, bucketListener)
 		select {
 			case watchResp := <- watchResp:
 				removeDynamicBucketListeners(dynamicBuckets, bucketListener)
 		 		return watchResp.waitIndex, watchResp.err
-		    case <-stopChan:
+		    case <-ctx.Done():
 				removeDynamicBucketListeners(dynamicBuckets, bucketListener)
-				return 0, nil
+				return 0, ctx.Err()
 		}
 	}
 }
 
+// Health returns an error if any bucket is served from the cache because
+// config-service cannot be reached.
+func (c *Client) Health(ctx context.Context) error {
+	if err := c.source.health(ctx); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var offline []string
+	for bucketName := range c.offline {
+		offline = append(offline, bucketName)
+	}
+	if len(offline) > 0 {
+		sort.Strings(offline)
+		return fmt.Errorf("buckets served from the cache: %s", strings.Join(offline, ", "))
+	}
+	return nil
+}
+
+// Close stops serving buckets, and tracking the watches of the buckets
+// fetched so far.
+func (c *Client) Close() error {
+	c.source.close()
+	return nil
+}
@@ -0,0 +1,423 @@
+package config_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	cfgsvc "github.com/Flipkart/config-service/client-go"
+	"github.com/kelseyhightower/confd/backends/config-service/cfgsvctest"
+	"github.com/kelseyhightower/confd/log"
+)
+
+func newTestClient(t *testing.T, server *cfgsvctest.Server, cacheDir string) *Client {
+	c, err := NewConfigClient(nil, cacheDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return c
+}
+
+// watchUntil runs WatchPrefix in the background and calls change until the
+// watch returns, since a change made before the watch listener is set up
+// would go unnoticed.
+func watchUntil(t *testing.T, c *Client, prefix string, change func()) (uint64, error) {
+	type result struct {
+		index uint64
+		err   error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan result, 1)
+	go func() {
+		index, err := c.WatchPrefix(ctx, prefix, 1)
+		results <- result{index, err}
+	}()
+	deadline := time.After(10 * time.Second)
+	for {
+		change()
+		select {
+		case r := <-results:
+			return r.index, r.err
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("WatchPrefix did not return")
+		}
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("b1", map[string]interface{}{"foo": "bar", "flag": true, "ratio": 1.5})
+	server.SetBucket("b2", map[string]interface{}{"foo": "override", "list": []interface{}{"a", "b"}})
+	c := newTestClient(t, server, "")
+
+	tests := []struct {
+		keys []string
+		want map[string]string
+	}{
+		{[]string{"/b1/foo"}, map[string]string{"foo": "bar"}},
+		{[]string{"/b1/foo", "/b1/missing"}, map[string]string{"foo": "bar"}},
+		{[]string{"/b1,b2/foo"}, map[string]string{"foo": "override"}},
+		{[]string{"/b1/*"}, map[string]string{"foo": "bar", "flag": "true", "ratio": "1.5"}},
+		{[]string{"/b1, b2/*"}, map[string]string{"foo": "override", "flag": "true", "ratio": "1.5", "list": `["a","b"]`}},
+		{[]string{"/b2/list", "/b1/flag"}, map[string]string{"list": `["a","b"]`, "flag": "true"}},
+	}
+	for _, tt := range tests {
+		got, err := c.GetValues(context.Background(), tt.keys)
+		if err != nil {
+			t.Errorf("GetValues(%v): %s", tt.keys, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetValues(%v) = %v, want %v", tt.keys, got, tt.want)
+		}
+	}
+
+	if _, err := c.GetValues(context.Background(), []string{"/missing/foo"}); err == nil {
+		t.Error("Expected GetValues on a missing bucket to fail")
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("b1", map[string]interface{}{"foo": "bar"})
+	server.SetBucket("b2", map[string]interface{}{"baz": "qux"})
+	c := newTestClient(t, server, "")
+
+	index, err := c.WatchPrefix(context.Background(), "/b1,b2", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if index != 1 {
+		t.Errorf("WatchPrefix(0) = %d, want 1", index)
+	}
+
+	index, err = watchUntil(t, c, "/b1,b2", func() {
+		server.SetBucket("b2", map[string]interface{}{"baz": "changed"})
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if index != 2 {
+		t.Errorf("WatchPrefix(1) = %d, want 2", index)
+	}
+	got, err := c.GetValues(context.Background(), []string{"/b2/baz"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got["baz"] != "changed" {
+		t.Errorf("Expected updated value, got %v", got)
+	}
+}
+
+func TestWatchPrefixDeleted(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("b1", map[string]interface{}{"foo": "bar"})
+	c := newTestClient(t, server, "")
+
+	if _, err := c.WatchPrefix(context.Background(), "/b1", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err := watchUntil(t, c, "/b1", func() {
+		server.DeleteBucket("b1")
+	})
+	e, ok := err.(*BucketDeletedError)
+	if !ok {
+		t.Fatalf("Expected a BucketDeletedError, got %v", err)
+	}
+	if e.Bucket != "b1" {
+		t.Errorf("Expected deleted bucket b1, got %s", e.Bucket)
+	}
+}
+
+func TestClose(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("b1", map[string]interface{}{"foo": "bar"})
+	server.SetBucket("b2", map[string]interface{}{"baz": "qux"})
+	c := newTestClient(t, server, "")
+	if _, err := c.GetValues(context.Background(), []string{"/b1/foo"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	// A closed client serves no bucket, even one fetched before.
+	for _, key := range []string{"/b1/foo", "/b2/baz"} {
+		if _, err := c.GetValues(context.Background(), []string{key}); err == nil {
+			t.Errorf("Expected a closed client not to fetch %s", key)
+		}
+	}
+}
+
+func TestOfflineCache(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(d time.Duration) { reconnectInterval = d }(reconnectInterval)
+	reconnectInterval = 50 * time.Millisecond
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(cacheDir)
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("b1", map[string]interface{}{"foo": "bar"})
+
+	// Populate the cache.
+	if _, err := newTestClient(t, server, cacheDir).GetValues(context.Background(), []string{"/b1/foo"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A fresh confd starts from the cache while config-service is down.
+	server.SetAvailable(false)
+	c := newTestClient(t, server, cacheDir)
+	got, err := c.GetValues(context.Background(), []string{"/b1/foo"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got["foo"] != "bar" {
+		t.Errorf("Expected cached value, got %v", got)
+	}
+	if _, err := c.GetValues(context.Background(), []string{"/b2/foo"}); err == nil {
+		t.Error("Expected GetValues on an uncached bucket to fail")
+	}
+	if err := c.Health(context.Background()); err == nil {
+		t.Error("Expected Health to fail while serving from the cache")
+	}
+
+	// Once config-service is back the watch fires and values are live.
+	index, err := watchUntil(t, c, "/b1", func() {
+		server.SetBucket("b1", map[string]interface{}{"foo": "live"})
+		server.SetAvailable(true)
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if index != 2 {
+		t.Errorf("WatchPrefix(1) = %d, want 2", index)
+	}
+	got, err = c.GetValues(context.Background(), []string{"/b1/foo"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got["foo"] != "live" {
+		t.Errorf("Expected live value, got %v", got)
+	}
+	if err := c.Health(context.Background()); err != nil {
+		t.Errorf("Unexpected Health error: %s", err.Error())
+	}
+}
+
+// getValuesPerKey resolves the buckets of every key separately, as GetValues
+// used to. It is kept as the baseline for BenchmarkGetValues.
+func (c *Client) getValuesPerKey(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, v := range keys {
+		bucketsKey := strings.Split(strings.TrimPrefix(v, "/"), "/")
+		key := bucketsKey[1]
+		buckets, _, err := c.getBuckets(strings.Split(bucketsKey[0], ","))
+		if err != nil {
+			return vars, err
+		}
+		for _, b := range buckets {
+			var requestedKeys []string
+			if key == "*" {
+				for k := range b.GetKeys() {
+					requestedKeys = append(requestedKeys, k)
+				}
+			} else {
+				requestedKeys = []string{key}
+			}
+			for _, k := range requestedKeys {
+				setValue(vars, k, b.GetKeys()[k])
+			}
+		}
+	}
+	return vars, nil
+}
+
+func benchmarkGetValues(b *testing.B, getValues func(*Client, context.Context, []string) (map[string]string, error)) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	values := make(map[string]interface{})
+	var keys []string
+	for i := 0; i < 150; i++ {
+		k := fmt.Sprintf("key%d", i)
+		values[k] = k
+		keys = append(keys, "/app,app-overrides/"+k)
+	}
+	keys = append(keys, "/app,app-overrides/*")
+	server.SetBucket("app", values)
+	server.SetBucket("app-overrides", map[string]interface{}{"key1": "override"})
+	c, err := NewConfigClient(nil, "")
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	if _, err := getValues(c, context.Background(), keys); err != nil {
+		b.Fatal(err.Error())
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getValues(c, context.Background(), keys); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkGetValues(b *testing.B) {
+	benchmarkGetValues(b, (*Client).GetValues)
+}
+
+func BenchmarkGetValuesPerKey(b *testing.B) {
+	benchmarkGetValues(b, (*Client).getValuesPerKey)
+}
+
+func TestHealth(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("b1", map[string]interface{}{"foo": "bar"})
+	c := newTestClient(t, server, "")
+	defer c.Close()
+	if err := c.Health(context.Background()); err != nil {
+		t.Errorf("Unexpected Health error before any bucket is fetched: %s", err.Error())
+	}
+	if _, err := c.GetValues(context.Background(), []string{"/b1/foo"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.Health(context.Background()); err != nil {
+		t.Errorf("Unexpected Health error: %s", err.Error())
+	}
+
+	// The watch of b1 fails, even though b1 is still served from memory.
+	server.SetAvailable(false)
+	waitForHealth(t, c, false)
+	// The watch reconnects once config-service answers it again.
+	server.SetWatchTimeout(100 * time.Millisecond)
+	server.SetAvailable(true)
+	waitForHealth(t, c, true)
+}
+
+func TestHealthWatchTimeout(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetWatchTimeout(50 * time.Millisecond)
+	server.SetBucket("b1", map[string]interface{}{"foo": "bar"})
+	c := newTestClient(t, server, "")
+	defer c.Close()
+	if _, err := c.GetValues(context.Background(), []string{"/b1/foo"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Watches answered as not modified neither fire nor make confd unhealthy.
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := c.WatchPrefix(ctx, "/b1", 1); err != context.DeadlineExceeded {
+		t.Errorf("Expected WatchPrefix to wait for a change, got %v", err)
+	}
+	if err := c.Health(context.Background()); err != nil {
+		t.Errorf("Unexpected Health error: %s", err.Error())
+	}
+}
+
+func TestHealthBucketRecreated(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetWatchTimeout(100 * time.Millisecond)
+	server.SetBucket("b1", map[string]interface{}{"foo": "bar"})
+	c := newTestClient(t, server, "")
+	defer c.Close()
+	if _, err := c.GetValues(context.Background(), []string{"/b1/foo"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The watch of a deleted bucket is no longer tracked.
+	server.DeleteBucket("b1")
+	deadline := time.Now().Add(10 * time.Second)
+	for watched(c, "b1") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the watch of the deleted bucket b1 to be dropped")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	waitForHealth(t, c, true)
+
+	// The watch of the bucket created again is tracked in its place.
+	server.SetBucket("b1", map[string]interface{}{"foo": "baz"})
+	if _, err := c.GetValues(context.Background(), []string{"/b1/foo"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !watched(c, "b1") {
+		t.Fatal("Expected the watch of the bucket b1 created again to be tracked")
+	}
+	waitForHealth(t, c, true)
+	server.SetAvailable(false)
+	waitForHealth(t, c, false)
+}
+
+// watched reports whether the watch of the named bucket is tracked.
+func watched(c *Client, name string) bool {
+	c.source.mutex.Lock()
+	defer c.source.mutex.Unlock()
+	_, ok := c.source.listeners[name]
+	return ok
+}
+
+// waitForHealth waits until Health reports config-service as reachable or
+// not, as the watches notice it.
+func waitForHealth(t *testing.T, c *Client, healthy bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := c.Health(context.Background())
+		if (err == nil) == healthy {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Health = %v, want healthy %v", err, healthy)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestBucketSourceHealth(t *testing.T) {
+	defer func(d time.Duration) { watchStaleAfter = d }(watchStaleAfter)
+	s := &bucketSource{listeners: make(map[string]*connectionListener)}
+	l := newConnectionListener(s, "b1", nil)
+	s.listeners["b1"] = l
+	if err := s.health(context.Background()); err != nil {
+		t.Errorf("Unexpected health error: %s", err.Error())
+	}
+	l.Disconnected("b1", errors.New("connection refused"))
+	if err := s.health(context.Background()); err == nil || !strings.Contains(err.Error(), "b1: connection refused") {
+		t.Errorf("Expected the disconnected watch of b1 to be reported, got %v", err)
+	}
+	l.Connected("b1")
+	if err := s.health(context.Background()); err != nil {
+		t.Errorf("Unexpected health error once reconnected: %s", err.Error())
+	}
+	l.Disconnected("b1", &cfgsvc.ErrorResp{ErrorType: cfgsvc.NOT_MODIFIED, Message: "not modified"})
+	if err := s.health(context.Background()); err != nil {
+		t.Errorf("Unexpected health error after a watch timeout: %s", err.Error())
+	}
+	watchStaleAfter = 0
+	if err := s.health(context.Background()); err == nil || !strings.Contains(err.Error(), "b1: no answer") {
+		t.Errorf("Expected the unanswered watch of b1 to be reported, got %v", err)
+	}
+}
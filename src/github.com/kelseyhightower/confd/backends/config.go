@@ -8,4 +8,5 @@ type Config struct {
 	BackendNodes []string
 	Scheme       string
 	Table        string
+	CacheDir     string
 }
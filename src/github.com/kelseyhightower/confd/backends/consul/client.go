@@ -1,8 +1,10 @@
 package consul
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"path"
@@ -13,7 +15,9 @@ import (
 
 // Client provides a wrapper around the consulkv client
 type ConsulClient struct {
-	client *api.KV
+	client    *api.KV
+	status    *api.Status
+	transport *http.Transport
 }
 
 // NewConsulClient returns a new client to Consul for the given address
@@ -44,21 +48,25 @@ func New(nodes []string, scheme, cert, key, caCert string) (*ConsulClient, error
 		caCertPool.AppendCertsFromPEM(ca)
 		tlsConfig.RootCAs = caCertPool
 	}
-	conf.HttpClient.Transport = &http.Transport{
+	transport := &http.Transport{
 		TLSClientConfig: tlsConfig,
 	}
+	conf.HttpClient.Transport = transport
 
 	client, err := api.NewClient(conf)
 	if err != nil {
 		return nil, err
 	}
-	return &ConsulClient{client.KV()}, nil
+	return &ConsulClient{client.KV(), client.Status(), transport}, nil
 }
 
 // GetValues queries Consul for keys
-func (c *ConsulClient) GetValues(keys []string) (map[string]string, error) {
+func (c *ConsulClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
 	vars := make(map[string]string)
 	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return vars, err
+		}
 		key := strings.TrimPrefix(key, "/")
 		pairs, _, err := c.client.List(key, nil)
 		if err != nil {
@@ -76,8 +84,8 @@ type watchResponse struct {
 	err       error
 }
 
-func (c *ConsulClient) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	respChan := make(chan watchResponse)
+func (c *ConsulClient) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
+	respChan := make(chan watchResponse, 1)
 	go func() {
 		opts := api.QueryOptions{
 			WaitIndex: waitIndex,
@@ -87,10 +95,34 @@ func (c *ConsulClient) WatchPrefix(prefix string, waitIndex uint64, stopChan cha
 	}()
 	for {
 		select {
-		case <-stopChan:
-			return waitIndex, nil
+		case <-ctx.Done():
+			return waitIndex, ctx.Err()
 		case r := <-respChan:
 			return r.waitIndex, r.err
 		}
 	}
 }
+
+// Health checks that the Consul cluster has a leader.
+func (c *ConsulClient) Health(ctx context.Context) error {
+	respChan := make(chan error, 1)
+	go func() {
+		leader, err := c.status.Leader()
+		if err == nil && leader == "" {
+			err = errors.New("consul cluster has no leader")
+		}
+		respChan <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-respChan:
+		return err
+	}
+}
+
+// Close closes the idle connections to Consul.
+func (c *ConsulClient) Close() error {
+	c.transport.CloseIdleConnections()
+	return nil
+}
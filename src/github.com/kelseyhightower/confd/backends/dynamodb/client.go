@@ -1,6 +1,7 @@
 package dynamodb
 
 import (
+	"context"
 	"os"
 
 	"github.com/awslabs/aws-sdk-go/aws"
@@ -42,9 +43,12 @@ func NewDynamoDBClient(table string) (*Client, error) {
 }
 
 // GetValues retrieves the values for the given keys from DynamoDB
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
 	vars := make(map[string]string)
 	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return vars, err
+		}
 		// Check if we can find the single item
 		g, err := c.client.GetItem(&dynamodb.GetItemInput{
 			Key: &map[string]*dynamodb.AttributeValue{
@@ -92,7 +96,27 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 }
 
 // WatchPrefix is not implemented
-func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	<-stopChan
-	return 0, nil
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// Health checks that the table can be described.
+func (c *Client) Health(ctx context.Context) error {
+	respChan := make(chan error, 1)
+	go func() {
+		_, err := c.client.DescribeTable(&dynamodb.DescribeTableInput{TableName: &c.table})
+		respChan <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-respChan:
+		return err
+	}
+}
+
+// Close does nothing, the DynamoDB client holds no connections of its own.
+func (c *Client) Close() error {
+	return nil
 }
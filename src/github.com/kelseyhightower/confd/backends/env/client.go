@@ -1,6 +1,7 @@
 package env
 
 import (
+	"context"
 	"os"
 	"strings"
 )
@@ -16,7 +17,7 @@ func NewEnvClient() (*Client, error) {
 }
 
 // GetValues queries the environment for keys
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
 	allEnvVars := os.Environ()
 	envMap := make(map[string]string)
 	for _, e := range allEnvVars {
@@ -47,7 +48,17 @@ func clean(key string) string {
 	return cleanReplacer.Replace(strings.ToLower(newKey))
 }
 
-func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	<-stopChan
-	return 0, nil
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// Health always succeeds, the environment is always available.
+func (c *Client) Health(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing, the client holds no connections.
+func (c *Client) Close() error {
+	return nil
 }
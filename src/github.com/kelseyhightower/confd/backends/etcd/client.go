@@ -1,6 +1,7 @@
 package etcd
 
 import (
+	"context"
 	"errors"
 	"strings"
 	"time"
@@ -36,9 +37,12 @@ func NewEtcdClient(machines []string, cert, key string, caCert string) (*Client,
 }
 
 // GetValues queries etcd for keys prefixed by prefix.
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
 	vars := make(map[string]string)
 	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return vars, err
+		}
 		resp, err := c.client.Get(key, true, true)
 		if err != nil {
 			return vars, err
@@ -66,7 +70,7 @@ func nodeWalk(node *goetcd.Node, vars map[string]string) error {
 	return nil
 }
 
-func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
 	if waitIndex == 0 {
 		resp, err := c.client.Get(prefix, false, true)
 		if err != nil {
@@ -74,7 +78,21 @@ func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool
 		}
 		return resp.EtcdIndex, nil
 	}
+	// go-etcd cancels a watch by closing its stop channel.
+	stopChan := make(chan bool)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stopChan)
+		case <-done:
+		}
+	}()
 	resp, err := c.client.Watch(prefix, waitIndex+1, true, nil, stopChan)
+	if ctx.Err() != nil {
+		return waitIndex, ctx.Err()
+	}
 	if err != nil {
 		switch e := err.(type) {
 		case *goetcd.EtcdError:
@@ -86,3 +104,26 @@ func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool
 	}
 	return resp.Node.ModifiedIndex, err
 }
+
+// Health checks that the etcd cluster can be reached.
+func (c *Client) Health(ctx context.Context) error {
+	respChan := make(chan bool, 1)
+	go func() {
+		respChan <- c.client.SyncCluster()
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ok := <-respChan:
+		if !ok {
+			return errors.New("cannot connect to etcd cluster: " + strings.Join(c.client.GetCluster(), ","))
+		}
+		return nil
+	}
+}
+
+// Close closes the connections to etcd.
+func (c *Client) Close() error {
+	c.client.Close()
+	return nil
+}
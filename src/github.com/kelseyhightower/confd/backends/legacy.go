@@ -0,0 +1,76 @@
+package backends
+
+import (
+	"context"
+	"io"
+)
+
+// LegacyStoreClient is the StoreClient interface of earlier versions of
+// confd, where calls cannot be given a deadline and a watch is canceled by
+// closing stopChan.
+type LegacyStoreClient interface {
+	GetValues(keys []string) (map[string]string, error)
+	WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error)
+}
+
+// FromLegacy adapts a LegacyStoreClient to StoreClient.
+//
+// A GetValues call whose context is done returns right away while the
+// legacy call completes in the background, and a canceled WatchPrefix
+// closes the stopChan of the legacy call. Legacy clients cannot report
+// their health, so Health always succeeds. Close closes c if it
+// implements io.Closer.
+func FromLegacy(c LegacyStoreClient) StoreClient {
+	return &legacyStoreClient{c}
+}
+
+type legacyStoreClient struct {
+	client LegacyStoreClient
+}
+
+type legacyResult struct {
+	vars  map[string]string
+	index uint64
+	err   error
+}
+
+func (c *legacyStoreClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	results := make(chan legacyResult, 1)
+	go func() {
+		vars, err := c.client.GetValues(keys)
+		results <- legacyResult{vars: vars, err: err}
+	}()
+	select {
+	case r := <-results:
+		return r.vars, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *legacyStoreClient) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
+	stopChan := make(chan bool)
+	results := make(chan legacyResult, 1)
+	go func() {
+		index, err := c.client.WatchPrefix(prefix, waitIndex, stopChan)
+		results <- legacyResult{index: index, err: err}
+	}()
+	select {
+	case r := <-results:
+		return r.index, r.err
+	case <-ctx.Done():
+		close(stopChan)
+		return waitIndex, ctx.Err()
+	}
+}
+
+func (c *legacyStoreClient) Health(ctx context.Context) error {
+	return nil
+}
+
+func (c *legacyStoreClient) Close() error {
+	if closer, ok := c.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package backends
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// oldClient implements LegacyStoreClient.
+type oldClient struct {
+	closed bool
+}
+
+func (c *oldClient) GetValues(keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, k := range keys {
+		vars[k] = "v"
+	}
+	return vars, nil
+}
+
+func (c *oldClient) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	<-stopChan
+	return waitIndex, nil
+}
+
+func (c *oldClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestFromLegacy(t *testing.T) {
+	legacy := &oldClient{}
+	c := FromLegacy(legacy)
+	ctx := context.Background()
+	vars, err := c.GetValues(ctx, []string{"/a"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := map[string]string{"/a": "v"}; !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues = %v, want %v", vars, want)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.WatchPrefix(ctx, "/a", 1); err != context.DeadlineExceeded {
+		t.Errorf("WatchPrefix = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if err := c.Health(context.Background()); err != nil {
+		t.Errorf("Unexpected Health error: %s", err.Error())
+	}
+	if err := c.Close(); err != nil || !legacy.closed {
+		t.Error("Expected Close to close the legacy client")
+	}
+}
@@ -1,16 +1,21 @@
 package redis
 
 import (
+	"context"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Client is a wrapper around the redis client
 type Client struct {
 	client redis.Conn
+	// mutex serializes commands, as a redis.Conn cannot be used by several
+	// goroutines at once.
+	mutex sync.Mutex
 }
 
 // NewRedisClient returns an *redis.Client with a connection to named machines.
@@ -27,15 +32,20 @@ func NewRedisClient(machines []string) (*Client, error) {
 		if err != nil {
 			continue
 		}
-		return &Client{conn}, nil
+		return &Client{client: conn}, nil
 	}
 	return nil, err
 }
 
 // GetValues queries redis for keys prefixed by prefix.
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	vars := make(map[string]string)
 	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return vars, err
+		}
 		key = strings.Replace(key, "/*", "", -1)
 		value, err := redis.String(c.client.Do("GET", key))
 		if err == nil {
@@ -79,7 +89,32 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 }
 
 // WatchPrefix is not yet implemented.
-func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	<-stopChan
-	return 0, nil
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// Health pings the redis server.
+func (c *Client) Health(ctx context.Context) error {
+	// The ping waits for the commands in progress, which may outlast ctx.
+	respChan := make(chan error, 1)
+	go func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		_, err := c.client.Do("PING")
+		respChan <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-respChan:
+		return err
+	}
+}
+
+// Close closes the connection to the redis server.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.client.Close()
 }
@@ -1,6 +1,8 @@
 package zookeeper
 
 import (
+	"context"
+	"errors"
 	"strings"
 	"time"
 
@@ -54,9 +56,12 @@ func nodeWalk(prefix string, c *Client, vars map[string]string) error {
 	return nil
 }
 
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
 	vars := make(map[string]string)
 	for _, v := range keys {
+		if err := ctx.Err(); err != nil {
+			return vars, err
+		}
 		v = strings.Replace(v, "/*", "", -1)
 		_, _, err := c.client.Exists(v)
 		if err != nil {
@@ -81,7 +86,21 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 // We also need to encourage users to set prefix and add a flag to enale support for "" prefix (aka "/")
 //
 
-func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	<-stopChan
-	return 0, nil
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// Health checks that the client has a zookeeper session.
+func (c *Client) Health(ctx context.Context) error {
+	if state := c.client.State(); state != zk.StateHasSession {
+		return errors.New("no zookeeper session: " + state.String())
+	}
+	return nil
+}
+
+// Close closes the zookeeper session.
+func (c *Client) Close() error {
+	c.client.Close()
+	return nil
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kelseyhightower/confd/resource/template"
+)
+
+// runCommand runs the confd command in args, writing its output to w, and
+// returns its exit code.
+func runCommand(args []string, w io.Writer) int {
+	var err error
+	switch args[0] {
+	case "history":
+		err = history(args[1:], w)
+	case "rollback":
+		err = rollback(args[1:], w)
+	case "release":
+		err = release(args[1:], w)
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "confd: "+err.Error())
+		return 1
+	}
+	return 0
+}
+
+// history lists the backups of a template resource or, given one of them,
+// diffs it against the current dest.
+func history(args []string, w io.Writer) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: confd history <resource> [<backup>]")
+	}
+	dest, backups, err := template.Backups(templateConfig, args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		for _, b := range backups {
+			if b.Name == args[1] {
+				return diff(b.Path, dest, w)
+			}
+		}
+		return fmt.Errorf("no backup %s of %s", args[1], args[0])
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKUP\tSAVED\tSIZE\tMODE\tOWNER")
+	for _, b := range backups {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d:%d\n", b.Name, b.Time.Local().Format("2006-01-02 15:04:05"), b.Size, b.Mode, b.Uid, b.Gid)
+	}
+	return tw.Flush()
+}
+
+// diff writes the differences between the files a and b to w.
+// It returns an error if they cannot be compared.
+func diff(a, b string, w io.Writer) error {
+	c := exec.Command("diff", "-u", a, b)
+	c.Stdout = w
+	c.Stderr = os.Stderr
+	err := c.Run()
+	// diff exits with 1 when the files differ.
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 1 {
+			return nil
+		}
+	}
+	return err
+}
+
+// rollback restores a backup of a template resource and holds it there.
+func rollback(args []string, w io.Writer) error {
+	usage := errors.New("usage: confd rollback <resource> [--to <backup>]")
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		return usage
+	}
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	to := fs.String("to", "", "backup to restore, the most recent one by default")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 {
+		return usage
+	}
+	b, err := template.Rollback(templateConfig, args[0], *to)
+	if b.Name != "" {
+		fmt.Fprintf(w, "Restored %s. %s is held until confd release %s is run\n", b.Name, args[0], args[0])
+	}
+	return err
+}
+
+// release lets a template resource held by rollback be rendered again and
+// asks the running confd, if any, to render it right away.
+func release(args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: confd release <resource>")
+	}
+	if err := template.Release(templateConfig, args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Released %s\n", args[0])
+	if err := triggerResource(args[0]); err != nil {
+		fmt.Fprintf(w, "It will be rendered the next time confd processes it: %s\n", err.Error())
+	}
+	return nil
+}
+
+// triggerResource asks the running confd to process the template resource
+// named name through its admin server.
+// It returns an error if any.
+func triggerResource(name string) error {
+	if config.AdminListen == "" {
+		return errors.New("the admin server is disabled")
+	}
+	client := &http.Client{Timeout: time.Minute}
+	host := config.AdminListen
+	if strings.HasPrefix(host, "unix:") {
+		path := strings.TrimPrefix(host, "unix:")
+		client.Transport = &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		}
+		host = "unix"
+	} else if h, port, err := net.SplitHostPort(host); err == nil && (h == "" || h == "0.0.0.0") {
+		host = net.JoinHostPort("127.0.0.1", port)
+	}
+	resp, err := client.PostForm("http://"+host+"/trigger", url.Values{"resource": {name}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
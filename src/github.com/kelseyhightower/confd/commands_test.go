@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kelseyhightower/confd/log"
+	"github.com/kelseyhightower/confd/resource/template"
+)
+
+func TestHistory(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	dest := filepath.Join(confDir, "foo.conf")
+	backupDir := filepath.Join(confDir, "backups")
+	writeFile := func(path, contents string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	writeFile(filepath.Join(confDir, "conf.d", "app", "foo.toml"),
+		"[template]\nsrc = \"foo.tmpl\"\ndest = \""+dest+"\"\nkeys = [\"/foo\"]\n")
+	writeFile(dest, "foo = new\n")
+	backup := "20150102T030405.000000000Z-0123456789abcdef0123456789abcdef"
+	writeFile(filepath.Join(backupDir, "app", "foo", backup), "foo = old\n")
+
+	defer func(c template.Config) { templateConfig = c }(templateConfig)
+	templateConfig = template.Config{
+		BackupDir:   backupDir,
+		ConfDir:     confDir,
+		ConfigDir:   filepath.Join(confDir, "conf.d"),
+		TemplateDir: filepath.Join(confDir, "templates"),
+	}
+
+	var out bytes.Buffer
+	if code := runCommand([]string{"history", "app/foo"}, &out); code != 0 {
+		t.Fatalf("history exited with %d", code)
+	}
+	if !strings.Contains(out.String(), backup) {
+		t.Errorf("Expected %s to be listed, got %q", backup, out.String())
+	}
+
+	out.Reset()
+	if code := runCommand([]string{"history", "app/foo", backup}, &out); code != 0 {
+		t.Fatalf("history exited with %d", code)
+	}
+	if !strings.Contains(out.String(), "-foo = old") || !strings.Contains(out.String(), "+foo = new") {
+		t.Errorf("Expected a diff of the backup against the dest, got %q", out.String())
+	}
+
+	if code := runCommand([]string{"history", "app/foo", "missing"}, &out); code == 0 {
+		t.Error("Expected history of a missing backup to fail")
+	}
+	if code := runCommand([]string{"history"}, &out); code == 0 {
+		t.Error("Expected history without a resource to fail")
+	}
+}
+
+func TestRollbackCommand(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	dest := filepath.Join(confDir, "foo.conf")
+	backupDir := filepath.Join(confDir, "backups")
+	for path, contents := range map[string]string{
+		filepath.Join(confDir, "conf.d", "foo.toml"): "[template]\nsrc = \"foo.tmpl\"\ndest = \"" + dest + "\"\nkeys = [\"/foo\"]\n",
+		dest: "foo = bad\n",
+		filepath.Join(backupDir, "foo", "20150102T030405.000000000Z-1"): "foo = older\n",
+		filepath.Join(backupDir, "foo", "20150102T030406.000000000Z-2"): "foo = good\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	var triggered []string
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		triggered = append(triggered, r.URL.Path+" "+r.FormValue("resource"))
+	}))
+	defer admin.Close()
+
+	defer func(c Config, tc template.Config) { config, templateConfig = c, tc }(config, templateConfig)
+	config.AdminListen = strings.TrimPrefix(admin.URL, "http://")
+	templateConfig = template.Config{
+		BackupDir:          backupDir,
+		ConfDir:            confDir,
+		ConfigDir:          filepath.Join(confDir, "conf.d"),
+		ReloadCmdMarkerDir: confDir,
+		TemplateDir:        filepath.Join(confDir, "templates"),
+	}
+
+	var out bytes.Buffer
+	if code := runCommand([]string{"rollback", "foo", "--to", "20150102T030405.000000000Z-1"}, &out); code != 0 {
+		t.Fatalf("rollback exited with %d", code)
+	}
+	if data, _ := ioutil.ReadFile(dest); string(data) != "foo = older\n" {
+		t.Errorf("Expected the chosen backup to be restored, got %q", string(data))
+	}
+	if code := runCommand([]string{"rollback", "foo"}, &out); code != 0 {
+		t.Fatalf("rollback exited with %d", code)
+	}
+	if data, _ := ioutil.ReadFile(dest); string(data) != "foo = good\n" {
+		t.Errorf("Expected the most recent backup to be restored, got %q", string(data))
+	}
+	if code := runCommand([]string{"rollback", "--to", "x", "foo"}, &out); code == 0 {
+		t.Error("Expected rollback with the resource last to fail")
+	}
+
+	if code := runCommand([]string{"release", "foo"}, &out); code != 0 {
+		t.Fatalf("release exited with %d", code)
+	}
+	if len(triggered) != 1 || triggered[0] != "/trigger foo" {
+		t.Errorf("Expected the released resource to be triggered, got %v", triggered)
+	}
+	if code := runCommand([]string{"release", "foo"}, &out); code == 0 {
+		t.Error("Expected releasing a resource that is not held to fail")
+	}
+}
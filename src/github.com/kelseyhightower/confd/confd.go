@@ -5,19 +5,16 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
+	"time"
 
 	"github.com/kelseyhightower/confd/backends"
 	"github.com/kelseyhightower/confd/log"
 	"github.com/kelseyhightower/confd/resource/template"
-	_ "net/http/pprof"
-	"net/http"
 )
 
 func main() {
-	go func() {
-		log.Info(fmt.Sprint(http.ListenAndServe("0.0.0.0:8801", nil)))
-	}()
 	flag.Parse()
 	if printVersion {
 		fmt.Printf("confd %s\n", Version)
@@ -26,6 +23,9 @@ func main() {
 	if err := initConfig(); err != nil {
 		log.Fatal(err.Error())
 	}
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args(), os.Stdout))
+	}
 
 	log.Info("Starting confd")
 
@@ -36,7 +36,9 @@ func main() {
 
 	templateConfig.StoreClient = storeClient
 	if onetime {
-		if err := template.Process(templateConfig); err != nil {
+		err := template.Process(templateConfig)
+		closeStoreClient(storeClient)
+		if err != nil {
 			os.Exit(1)
 		}
 		os.Exit(0)
@@ -49,24 +51,144 @@ func main() {
 	var processor template.Processor
 	switch {
 	case config.Watch:
-		processor = template.WatchProcessor(templateConfig, stopChan, doneChan, errChan)
+		processor = template.WatchProcessor(templateConfig, stopChan, doneChan, errChan, config.ResyncInterval)
 	default:
 		processor = template.IntervalProcessor(templateConfig, stopChan, doneChan, errChan, config.Interval)
 	}
 
+	if config.AdminListen != "" {
+		l, err := listenAdmin(config.AdminListen)
+		if err != nil {
+			log.Fatal("Cannot start admin server: " + err.Error())
+		}
+		go newAdminServer(config.Backend, storeClient, processor, config.MetricsPath, config.AdminPprof).serve(l)
+	}
+
 	go processor.Process()
 
+	// The template resource directories are watched until
+	// resourceDirStopChan is closed, and watched again when a reload
+	// changes them.
+	var resourceDirChan <-chan bool
+	var resourceDirStopChan chan bool
+	stopResourceDirs := func() {
+		if resourceDirStopChan != nil {
+			close(resourceDirStopChan)
+			resourceDirStopChan, resourceDirChan = nil, nil
+		}
+	}
+	watchResourceDirs := func() {
+		stopResourceDirs()
+		if config.WatchConfdir {
+			resourceDirStopChan = make(chan bool)
+			resourceDirChan = template.WatchResourceDirs(templateConfig, resourceDirStopChan)
+		}
+	}
+	watchResourceDirs()
+
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGHUP)
+	// shutdownTimeout fires once confd has waited long enough for the
+	// template resources being processed on shutdown.
+	var shutdownTimeout <-chan time.Time
 	for {
 		select {
 		case err := <-errChan:
 			log.Error(err.Error())
+		case <-resourceDirChan:
+			if shutdownTimeout != nil {
+				continue
+			}
+			log.Info("Template resources changed. Reloading them")
+			if err := processor.Reload(templateConfig); err != nil {
+				log.Error("Cannot reload template resources, keeping the running ones: " + err.Error())
+			}
 		case s := <-signalChan:
-			log.Info(fmt.Sprintf("Captured %v. Exiting...", s))
-			close(doneChan)
+			switch {
+			case s == syscall.SIGUSR1 && shutdownTimeout == nil:
+				log.Info(fmt.Sprintf("Captured %v. Processing all template resources", s))
+				go triggerAll(processor)
+			case s == syscall.SIGHUP && shutdownTimeout == nil:
+				log.Info(fmt.Sprintf("Captured %v. Reloading configuration", s))
+				watchConfdir, configDir, templateDir := config.WatchConfdir, templateConfig.ConfigDir, templateConfig.TemplateDir
+				if reloadConfig(processor, storeClient) && (config.WatchConfdir != watchConfdir ||
+					templateConfig.ConfigDir != configDir || templateConfig.TemplateDir != templateDir) {
+					watchResourceDirs()
+				}
+			case s == syscall.SIGUSR1 || s == syscall.SIGHUP:
+				log.Info(fmt.Sprintf("Captured %v while shutting down. Ignoring it", s))
+			case shutdownTimeout != nil:
+				log.Warning(fmt.Sprintf("Captured %v again. Exiting without waiting", s))
+				processor.RemoveStageFiles()
+				os.Exit(1)
+			default:
+				log.Info(fmt.Sprintf("Captured %v. Shutting down", s))
+				close(stopChan)
+				stopResourceDirs()
+				shutdownTimeout = time.After(time.Duration(config.ShutdownTimeout) * time.Second)
+			}
+		case <-shutdownTimeout:
+			log.Error("Timed out waiting for template resources being processed. Exiting")
+			processor.RemoveStageFiles()
+			os.Exit(1)
 		case <-doneChan:
+			closeStoreClient(storeClient)
+			log.Info("Shutdown complete")
 			os.Exit(0)
 		}
 	}
 }
+
+// closeStoreClient closes the connections to the backend.
+func closeStoreClient(storeClient backends.StoreClient) {
+	if err := storeClient.Close(); err != nil {
+		log.Warning("Cannot close the backend client: " + err.Error())
+	}
+}
+
+// triggerAll processes every template resource and logs the outcomes.
+func triggerAll(processor template.Processor) {
+	results, err := processor.Trigger("")
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	for _, r := range results {
+		log.Info(fmt.Sprintf("Processed %s on demand: %s", r.Name, r.Outcome))
+	}
+}
+
+// reloadConfig reads the confd config file and the template resources again
+// and applies them to processor. The running configuration is kept if either
+// cannot be loaded. Settings that are only read at startup, such as the
+// backend, keep their running values. It reports whether the configuration
+// was reloaded.
+func reloadConfig(processor template.Processor, storeClient backends.StoreClient) bool {
+	oldConfig, oldBackendsConfig, oldTemplateConfig := config, backendsConfig, templateConfig
+	restore := func() {
+		config, backendsConfig, templateConfig = oldConfig, oldBackendsConfig, oldTemplateConfig
+	}
+	if err := initConfig(); err != nil {
+		log.Error("Cannot reload configuration, keeping the running one: " + err.Error())
+		restore()
+		return false
+	}
+	if !reflect.DeepEqual(backendsConfig, oldBackendsConfig) {
+		log.Warning("Backend settings changed; restart confd to apply them")
+	}
+	if config.Watch != oldConfig.Watch || config.Interval != oldConfig.Interval ||
+		config.ResyncInterval != oldConfig.ResyncInterval || config.Concurrency != oldConfig.Concurrency ||
+		config.AdminListen != oldConfig.AdminListen || config.AdminPprof != oldConfig.AdminPprof ||
+		config.MetricsPath != oldConfig.MetricsPath {
+		log.Warning("Processing mode or admin server settings changed; restart confd to apply them")
+	}
+	templateConfig.Backend = oldTemplateConfig.Backend
+	templateConfig.StoreClient = storeClient
+	if err := processor.Reload(templateConfig); err != nil {
+		log.Error("Cannot reload template resources, keeping the running ones: " + err.Error())
+		restore()
+		return false
+	}
+	log.Info("Configuration reloaded")
+	return true
+}
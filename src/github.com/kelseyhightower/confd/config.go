@@ -20,68 +20,98 @@ import (
 var (
 	configFile        = ""
 	defaultConfigFile = "/etc/confd/confd.toml"
+	adminListen       string
+	adminPprof        bool
 	backend           string
+	backupDir         string
+	backupKeep        int
+	cacheDir          string
 	clientCaKeys      string
 	clientCert        string
 	clientKey         string
+	concurrency       int
 	confdir           string
 	config            Config // holds the global confd config.
 	interval          int
 	keepStageFile     bool
 	logLevel          string
+	metricsPath       string
 	nodes             Nodes
 	noop              bool
 	onetime           bool
 	prefix            string
 	printVersion      bool
 	scheme            string
+	shutdownTimeout   int
 	srvDomain         string
 	table             string
 	templateConfig    template.Config
 	backendsConfig    backends.Config
 	watch             bool
+	watchConfdir      bool
 	reloadCmdMarkerDir string
+	resyncInterval    int
 )
 
 // A Config structure is used to configure confd.
 type Config struct {
+	AdminListen  string   `toml:"admin_listen"`
+	AdminPprof   bool     `toml:"admin_pprof"`
 	Backend      string   `toml:"backend"`
 	BackendNodes []string `toml:"nodes"`
+	BackupDir    string   `toml:"backup_dir"`
+	BackupKeep   int      `toml:"backup_keep"`
+	CacheDir     string   `toml:"cache_dir"`
 	ClientCaKeys string   `toml:"client_cakeys"`
 	ClientCert   string   `toml:"client_cert"`
 	ClientKey    string   `toml:"client_key"`
+	Concurrency  int      `toml:"concurrency"`
 	ConfDir      string   `toml:"confdir"`
 	Interval     int      `toml:"interval"`
 	Noop         bool     `toml:"noop"`
 	Prefix       string   `toml:"prefix"`
+	ResyncInterval int    `toml:"resync_interval"`
 	SRVDomain    string   `toml:"srv_domain"`
 	Scheme       string   `toml:"scheme"`
+	ShutdownTimeout int   `toml:"shutdown_timeout"`
 	Table        string   `toml:"table"`
 	LogLevel     string   `toml:"log-level"`
+	MetricsPath  string   `toml:"metrics_path"`
 	Watch        bool     `toml:"watch"`
-	ReloadCmdMarkerDir string `toml:"reload_cmd_marker_dir`
+	WatchConfdir bool     `toml:"watch_confdir"`
+	ReloadCmdMarkerDir string `toml:"reload_cmd_marker_dir"`
 }
 
 func init() {
+	flag.StringVar(&adminListen, "admin-listen", "127.0.0.1:8801", "address of the admin server, host:port or unix:/path (empty to disable)")
+	flag.BoolVar(&adminPprof, "admin-pprof", false, "serve pprof profiles from the admin server")
 	flag.StringVar(&backend, "backend", "etcd", "backend to use")
+	flag.StringVar(&backupDir, "backup-dir", "", "directory to save dest files to before they are replaced (empty to disable)")
+	flag.IntVar(&backupKeep, "backup-keep", 10, "number of backups kept per template resource (0 to keep all)")
+	flag.StringVar(&cacheDir, "cache-dir", "", "directory to cache config-service buckets for offline use")
 	flag.StringVar(&clientCaKeys, "client-ca-keys", "", "client ca keys")
 	flag.StringVar(&clientCert, "client-cert", "", "the client cert")
 	flag.StringVar(&clientKey, "client-key", "", "the client key")
+	flag.IntVar(&concurrency, "concurrency", 1, "number of template resources processed at once")
 	flag.StringVar(&confdir, "confdir", "/etc/confd", "confd conf directory")
 	flag.StringVar(&configFile, "config-file", "", "the confd config file")
 	flag.IntVar(&interval, "interval", 600, "backend polling interval")
 	flag.BoolVar(&keepStageFile, "keep-stage-file", false, "keep staged files")
 	flag.StringVar(&logLevel, "log-level", "", "level which confd should log messages")
+	flag.StringVar(&metricsPath, "metrics-path", "/metrics", "path of the Prometheus metrics on the admin server (empty to disable)")
 	flag.Var(&nodes, "node", "list of backend nodes")
 	flag.BoolVar(&noop, "noop", false, "only show pending changes")
 	flag.BoolVar(&onetime, "onetime", false, "run once and exit")
 	flag.StringVar(&prefix, "prefix", "/", "key path prefix")
+	flag.IntVar(&resyncInterval, "resync-interval", 0, "in watch mode, also process all template resources about every n seconds (0 to disable)")
 	flag.BoolVar(&printVersion, "version", false, "print version and exit")
 	flag.StringVar(&scheme, "scheme", "http", "the backend URI scheme (http or https)")
+	flag.IntVar(&shutdownTimeout, "shutdown-timeout", 30, "seconds to wait for template resources being processed on shutdown")
 	flag.StringVar(&srvDomain, "srv-domain", "", "the name of the resource record")
 	flag.StringVar(&table, "table", "", "the name of the DynamoDB table (only used with -backend=dynamodb)")
 	flag.BoolVar(&watch, "watch", false, "enable watch support")
-	flag.StringVar(&reloadCmdMarkerDir, "reload_cmd_marker_dir", "/var/lib/confd", "indicates successful execution of reload command")
+	flag.BoolVar(&watchConfdir, "watch-confdir", false, "load template resources and templates as they are added, changed or removed")
+	flag.StringVar(&reloadCmdMarkerDir, "reload_cmd_marker_dir", "/var/lib/confd", "directory holding the state of the template resources")
 }
 
 // initConfig initializes the confd configuration by first setting defaults,
@@ -97,11 +127,16 @@ func initConfig() error {
 	}
 	// Set defaults.
 	config = Config{
+		AdminListen: "127.0.0.1:8801",
 		Backend:  "etcd",
+		BackupKeep: 10,
+		Concurrency: 1,
 		ConfDir:  "/etc/confd",
 		Interval: 600,
+		MetricsPath: "/metrics",
 		Prefix:   "/",
 		Scheme:   "http",
+		ShutdownTimeout: 30,
 		ReloadCmdMarkerDir: "/var/lib/confd",
 	}
 	// Update config from the TOML configuration file.
@@ -164,9 +199,22 @@ func initConfig() error {
 		}
 
 		if unsupportedBackends[config.Backend] {
-			log.Info(fmt.Sprintf("Watch is not supported for backend %s. Exiting...", config.Backend))
-			os.Exit(1)
+			return fmt.Errorf("Watch is not supported for backend %s", config.Backend)
 		}
+	} else if config.ResyncInterval > 0 {
+		log.Warning("resync_interval only applies in watch mode and is ignored")
+	}
+	if config.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if config.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout must not be negative")
+	}
+	if config.ResyncInterval < 0 {
+		return errors.New("resync_interval must not be negative")
+	}
+	if config.BackupKeep < 0 {
+		return errors.New("backup_keep must not be negative")
 	}
 
 	if config.Backend == "dynamodb" && config.Table == "" {
@@ -181,9 +229,14 @@ func initConfig() error {
 		BackendNodes: config.BackendNodes,
 		Scheme:       config.Scheme,
 		Table:        config.Table,
+		CacheDir:     config.CacheDir,
 	}
 	// Template configuration.
 	templateConfig = template.Config{
+		Backend:       config.Backend,
+		BackupDir:     config.BackupDir,
+		BackupKeep:    config.BackupKeep,
+		Concurrency:   config.Concurrency,
 		ConfDir:       config.ConfDir,
 		ConfigDir:     filepath.Join(config.ConfDir, "conf.d"),
 		KeepStageFile: keepStageFile,
@@ -235,14 +288,26 @@ func processEnv() {
 
 func setConfigFromFlag(f *flag.Flag) {
 	switch f.Name {
+	case "admin-listen":
+		config.AdminListen = adminListen
+	case "admin-pprof":
+		config.AdminPprof = adminPprof
 	case "backend":
 		config.Backend = backend
+	case "backup-dir":
+		config.BackupDir = backupDir
+	case "backup-keep":
+		config.BackupKeep = backupKeep
+	case "cache-dir":
+		config.CacheDir = cacheDir
 	case "client-cert":
 		config.ClientCert = clientCert
 	case "client-key":
 		config.ClientKey = clientKey
 	case "client-ca-keys":
 		config.ClientCaKeys = clientCaKeys
+	case "concurrency":
+		config.Concurrency = concurrency
 	case "confdir":
 		config.ConfDir = confdir
 	case "node":
@@ -253,16 +318,24 @@ func setConfigFromFlag(f *flag.Flag) {
 		config.Noop = noop
 	case "prefix":
 		config.Prefix = prefix
+	case "resync-interval":
+		config.ResyncInterval = resyncInterval
 	case "scheme":
 		config.Scheme = scheme
+	case "shutdown-timeout":
+		config.ShutdownTimeout = shutdownTimeout
 	case "srv-domain":
 		config.SRVDomain = srvDomain
 	case "table":
 		config.Table = table
 	case "log-level":
 		config.LogLevel = logLevel
+	case "metrics-path":
+		config.MetricsPath = metricsPath
 	case "watch":
 		config.Watch = watch
+	case "watch-confdir":
+		config.WatchConfdir = watchConfdir
 	case "reload_cmd_marker_dir":
 		config.ReloadCmdMarkerDir = reloadCmdMarkerDir
 	}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
 
@@ -10,17 +12,22 @@ import (
 func TestInitConfigDefaultConfig(t *testing.T) {
 	log.SetLevel("warn")
 	want := Config{
+		AdminListen:  "127.0.0.1:8801",
 		Backend:      "etcd",
 		BackendNodes: []string{"http://127.0.0.1:4001"},
+		BackupKeep:   10,
 		ClientCaKeys: "",
 		ClientCert:   "",
 		ClientKey:    "",
+		Concurrency:  1,
 		ConfDir:      "/etc/confd",
 		Interval:     600,
+		MetricsPath:  "/metrics",
 		Noop:         false,
 		Prefix:       "/",
 		SRVDomain:    "",
 		Scheme:       "http",
+		ShutdownTimeout: 30,
 		Table:        "",
 		ReloadCmdMarkerDir: "/var/lib/confd",
 	}
@@ -31,3 +38,21 @@ func TestInitConfigDefaultConfig(t *testing.T) {
 		t.Errorf("initConfig() = %v, want %v", config, want)
 	}
 }
+
+func TestInitConfigWatchUnsupported(t *testing.T) {
+	log.SetLevel("warn")
+	f, err := ioutil.TempFile("", "confd.toml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("backend = \"redis\"\nwatch = true\n"); err != nil {
+		t.Fatal(err.Error())
+	}
+	f.Close()
+	defer func(path string) { configFile = path }(configFile)
+	configFile = f.Name()
+	if err := initConfig(); err == nil {
+		t.Error("Expected initConfig to fail on watch with the redis backend")
+	}
+}
@@ -0,0 +1,140 @@
+package template
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// backupTimeFormat names backups so that they sort by time.
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// Backup is a copy of a dest file saved before it was replaced.
+type Backup struct {
+	// Name identifies the backup among those of its template resource.
+	Name string
+	Path string
+	Time time.Time
+	Hash string
+	Size int64
+	Mode os.FileMode
+	Uid  int
+	Gid  int
+}
+
+// backupDir returns the directory holding the backups of t.
+func (t *TemplateResource) backupDir() string {
+	return filepath.Join(t.BackupDir, t.name)
+}
+
+// backup saves previous, the dest of t about to be replaced, unless
+// backups are disabled or there was no dest. The oldest backups beyond
+// BackupKeep are removed.
+// It returns an error if any.
+func (t *TemplateResource) backup(previous *previousDest) error {
+	if t.BackupDir == "" || !previous.exists {
+		return nil
+	}
+	dir := t.backupDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%x", time.Now().UTC().Format(backupTimeFormat), md5.Sum(previous.contents))
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, previous.contents, previous.mode); err != nil {
+		return err
+	}
+	// WriteFile does not apply the mode to an existing file or beyond the
+	// umask.
+	os.Chmod(path, previous.mode)
+	os.Chown(path, previous.uid, previous.gid)
+	log.Debug("Backed up " + t.Dest + " to " + path)
+	return t.pruneBackups()
+}
+
+// pruneBackups removes the oldest backups of t beyond BackupKeep.
+// It returns an error if any.
+func (t *TemplateResource) pruneBackups() error {
+	if t.BackupKeep == 0 {
+		return nil
+	}
+	backups, err := listBackups(t.backupDir())
+	if err != nil {
+		return err
+	}
+	for i := t.BackupKeep; i < len(backups); i++ {
+		if err := os.Remove(backups[i].Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listBackups returns the backups in dir, newest first.
+// It returns an error if any.
+func listBackups(dir string) ([]Backup, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []Backup
+	for _, fi := range infos {
+		parts := strings.SplitN(fi.Name(), "-", 2)
+		if fi.IsDir() || len(parts) != 2 {
+			continue
+		}
+		tm, err := time.Parse(backupTimeFormat, parts[0])
+		if err != nil {
+			continue
+		}
+		b := Backup{
+			Name: fi.Name(),
+			Path: filepath.Join(dir, fi.Name()),
+			Time: tm,
+			Hash: parts[1],
+			Size: fi.Size(),
+			Mode: fi.Mode(),
+			Uid:  -1,
+			Gid:  -1,
+		}
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			b.Uid, b.Gid = int(stat.Uid), int(stat.Gid)
+		}
+		backups = append(backups, b)
+	}
+	sort.Sort(sort.Reverse(byName(backups)))
+	return backups, nil
+}
+
+type byName []Backup
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Backups returns the dest of the template resource named name, which is
+// the path of its TOML file under ConfigDir without the extension, and its
+// backups, newest first.
+// It returns an error if any.
+func Backups(config Config, name string) (string, []Backup, error) {
+	t, err := loadTemplateResource(filepath.Join(config.ConfigDir, name+".toml"), config)
+	if err != nil {
+		return "", nil, err
+	}
+	if t.BackupDir == "" {
+		return t.Dest, nil, fmt.Errorf("backups of %s are disabled, set backup_dir", name)
+	}
+	backups, err := listBackups(t.backupDir())
+	return t.Dest, backups, err
+}
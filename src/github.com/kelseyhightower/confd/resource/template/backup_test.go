@@ -0,0 +1,80 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kelseyhightower/confd/backends/env"
+	"github.com/kelseyhightower/confd/log"
+)
+
+func TestBackup(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	err = ioutil.WriteFile(filepath.Join(confDir, "templates", "foo.tmpl"), []byte(`foo = {{getv "/backup/foo"}}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dest := filepath.Join(confDir, "foo.conf")
+	resource := "[template]\nsrc = \"foo.tmpl\"\ndest = \"" + dest + "\"\nmode = \"0640\"\nkeys = [\"/backup/foo\"]\nbackup_keep = 2\n"
+	if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", "foo.toml"), []byte(resource), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := Config{
+		BackupDir:   filepath.Join(confDir, "backups"),
+		BackupKeep:  10,
+		ConfDir:     confDir,
+		ConfigDir:   filepath.Join(confDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(confDir, "templates"),
+	}
+	tr, err := NewTemplateResource(filepath.Join(confDir, "conf.d", "foo.toml"), config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Unsetenv("BACKUP_FOO")
+	for _, v := range []string{"a", "b", "c", "d"} {
+		os.Setenv("BACKUP_FOO", v)
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	gotDest, backups, err := Backups(config, "foo")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if gotDest != dest {
+		t.Errorf("Expected dest %s, got %s", dest, gotDest)
+	}
+	// The first render replaced nothing and backup_keep overrides the
+	// global setting.
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %d", len(backups))
+	}
+	for i, want := range []string{"foo = c", "foo = b"} {
+		data, err := ioutil.ReadFile(backups[i].Path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != want {
+			t.Errorf("Expected backup %d to hold %q, got %q", i, want, string(data))
+		}
+		if backups[i].Mode != 0640 {
+			t.Errorf("Expected backup %d to keep mode 0640, got %s", i, backups[i].Mode)
+		}
+	}
+	if !backups[0].Time.After(backups[1].Time) {
+		t.Error("Expected backups newest first")
+	}
+}
@@ -0,0 +1,141 @@
+package template
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// cmdContext describes the change a check or reload command runs for.
+type cmdContext struct {
+	// src is the rendered file: the stage file for the check command and
+	// the dest for the reload command.
+	src string
+	// oldHash and newHash are the md5 of the dest before and after the
+	// change, or empty if there is no such dest.
+	oldHash string
+	newHash string
+}
+
+// hashOf returns the md5 of contents, like fileStat.
+func hashOf(contents []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(contents))
+}
+
+// fileHash returns the md5 of the file at path, or "" if it cannot be read.
+func fileHash(path string) string {
+	fi, err := fileStat(path)
+	if err != nil {
+		return ""
+	}
+	return fi.Md5
+}
+
+// setReloadContext records the change the reload command of t runs for:
+// previous was replaced by the dest, or nil if the dest was not replaced.
+func (t *TemplateResource) setReloadContext(previous *previousDest) {
+	c := cmdContext{src: t.Dest, newHash: fileHash(t.Dest)}
+	switch {
+	case previous == nil:
+		c.oldHash = c.newHash
+	case previous.exists:
+		c.oldHash = hashOf(previous.contents)
+	}
+	t.reloadCtx = c
+}
+
+// setChangedKeys records the keys, without the prefix, whose values in
+// values differ from those of the previous render.
+func (t *TemplateResource) setChangedKeys(values map[string]string) {
+	var changed []string
+	for k, v := range values {
+		if old, ok := t.values[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range t.values {
+		if _, ok := values[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	t.changedKeys = changed
+	t.values = values
+}
+
+// commandVars returns the template variables of a check or reload command
+// of t run for c.
+func (t *TemplateResource) commandVars(c cmdContext) map[string]interface{} {
+	return map[string]interface{}{
+		"src":          c.src,
+		"dest":         t.Dest,
+		"resource":     t.name,
+		"old_hash":     c.oldHash,
+		"new_hash":     c.newHash,
+		"changed_keys": t.changedKeys,
+		"state":        t.statePath(),
+	}
+}
+
+// commandEnv returns the environment of a check or reload command of t run
+// for c: that of confd unless ClearEnv is set, then Env, then the variables
+// of c.
+func (t *TemplateResource) commandEnv(c cmdContext) []string {
+	return append(t.baseEnv(), t.contextEnv(c)...)
+}
+
+// baseEnv returns the environment of the commands of t before the variables
+// of the change they run for.
+func (t *TemplateResource) baseEnv() []string {
+	var env []string
+	if !t.ClearEnv {
+		env = os.Environ()
+	} else if _, ok := t.Env["PATH"]; !ok {
+		env = []string{"PATH=" + defaultPath}
+	}
+	for _, k := range sortedKeys(t.Env) {
+		env = append(env, k+"="+t.Env[k])
+	}
+	return env
+}
+
+// contextEnv returns the variables of c for a check or reload command of t.
+func (t *TemplateResource) contextEnv(c cmdContext) []string {
+	return []string{
+		"CONFD_SRC=" + c.src,
+		"CONFD_DEST=" + t.Dest,
+		"CONFD_RESOURCE=" + t.name,
+		"CONFD_OLD_HASH=" + c.oldHash,
+		"CONFD_NEW_HASH=" + c.newHash,
+		"CONFD_CHANGED_KEYS=" + strings.Join(t.changedKeys, "\n"),
+		"CONFD_STATE=" + t.statePath(),
+	}
+}
+
+// renderCommand executes the command template cmd with the variables of c.
+// It returns an error if any.
+func (t *TemplateResource) renderCommand(name, cmd string, c cmdContext) (string, error) {
+	var b bytes.Buffer
+	tmpl, err := template.New(name).Funcs(template.FuncMap{"shellquote": shellQuote}).Parse(cmd)
+	if err != nil {
+		return "", err
+	}
+	if err := tmpl.Execute(&b, t.commandVars(c)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// reloadCommand returns the reload command of t, with its variables if
+// ReloadCmdTemplate is set.
+// It returns an error if any.
+func (t *TemplateResource) reloadCommand() (string, error) {
+	if !t.ReloadCmdTemplate {
+		return t.ReloadCmd, nil
+	}
+	return t.renderCommand("reloadcmd", t.ReloadCmd, t.reloadCtx)
+}
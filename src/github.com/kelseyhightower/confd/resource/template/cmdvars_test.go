@@ -0,0 +1,88 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{"", "plain", "with space", "it's", `"$HOME" $(id) ; rm -rf /`, "'''"} {
+		out, err := exec.Command("/bin/sh", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(out) != s {
+			t.Errorf("Expected %q, got %q", s, out)
+		}
+	}
+}
+
+func TestCommandVars(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	dest := filepath.Join(confDir, "foo.conf")
+	if err := ioutil.WriteFile(dest, []byte("foo = old"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	checkEnv := filepath.Join(confDir, "check.env")
+	reloadVars := filepath.Join(confDir, "reload.vars")
+	tr := newRollbackResource(t, confDir, dest,
+		"check_cmd = 'env | grep ^CONFD_ | sort > "+checkEnv+"; test -f {{shellquote .src}}'\n"+
+			"reload_cmd = 'echo {{shellquote .resource}} {{.old_hash}} {{.new_hash}} {{range .changed_keys}}{{.}} {{end}}> "+reloadVars+"'\n"+
+			"reload_cmd_template = true\n")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	oldHash, newHash := hashOf([]byte("foo = old")), hashOf([]byte("foo = new"))
+	data, err := ioutil.ReadFile(checkEnv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	env := string(data)
+	for _, want := range []string{
+		"CONFD_SRC=" + filepath.Join(confDir, ".foo.conf"),
+		"CONFD_DEST=" + dest + "\n",
+		"CONFD_RESOURCE=foo\n",
+		"CONFD_OLD_HASH=" + oldHash + "\n",
+		"CONFD_NEW_HASH=" + newHash + "\n",
+		"CONFD_CHANGED_KEYS=/rollback/foo\n",
+		"CONFD_STATE=" + tr.statePath() + "\n",
+	} {
+		if !strings.Contains(env, want) {
+			t.Errorf("Expected the check command environment to contain %q, got:\n%s", want, env)
+		}
+	}
+	expectContents(t, reloadVars, "foo "+oldHash+" "+newHash+" /rollback/foo\n")
+
+	// Nothing changed since the previous render.
+	tr.setVars()
+	if len(tr.changedKeys) != 0 {
+		t.Errorf("Expected no changed keys, got %v", tr.changedKeys)
+	}
+}
+
+func TestReloadCommandTemplate(t *testing.T) {
+	tr := &TemplateResource{name: "foo", ReloadCmd: "docker ps --format '{{.ID}}'"}
+	cmd, err := tr.reloadCommand()
+	if err != nil || cmd != tr.ReloadCmd {
+		t.Errorf("Expected the reload command to be run as is, got %q, %v", cmd, err)
+	}
+	tr.ReloadCmd = "reload {{shellquote .resource}}"
+	tr.ReloadCmdTemplate = true
+	if cmd, err := tr.reloadCommand(); err != nil || cmd != "reload 'foo'" {
+		t.Errorf("Expected the reload command template to be executed, got %q, %v", cmd, err)
+	}
+}
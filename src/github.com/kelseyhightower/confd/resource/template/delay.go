@@ -0,0 +1,113 @@
+package template
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// setPending leaves the reload command of t to the end of the pass, after
+// previous replaced the dest, or nil if the dest was already in sync. A
+// reload put off earlier rolls back to the dest it replaced instead, which
+// is the one the service still runs with.
+func (t *TemplateResource) setPending(previous *previousDest) {
+	if t.delayed != nil && t.delayed.previous != nil {
+		previous = t.delayed.previous
+	}
+	t.delayed = nil
+	t.pending = &pendingReload{previous: previous}
+	t.setReloadContext(previous)
+}
+
+// reloadWait returns how long the reload command of t must wait so that it
+// does not run more often than MinReloadInterval, or 0.
+func (t *TemplateResource) reloadWait() time.Duration {
+	if t.MinReloadInterval == 0 || !t.reloads() {
+		return 0
+	}
+	t.statusMutex.Lock()
+	last := t.status.LastReload
+	t.statusMutex.Unlock()
+	if last.IsZero() {
+		return 0
+	}
+	wait := last.Add(time.Duration(t.MinReloadInterval) * time.Second).Sub(time.Now())
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// delay puts off the pending reload of the members of g that must wait for
+// their MinReloadInterval, and returns the other members.
+func (g reloadGroup) delay() reloadGroup {
+	var due reloadGroup
+	for _, t := range g {
+		if wait := t.reloadWait(); wait > 0 {
+			t.delayReload(wait)
+			continue
+		}
+		if t.reloadTimer != nil {
+			t.reloadTimer.Stop()
+			t.reloadTimer = nil
+		}
+		due = append(due, t)
+	}
+	return due
+}
+
+// delayReload puts off the pending reload of t by wait, after which t is
+// processed again so that the reload command runs for its latest dest.
+func (t *TemplateResource) delayReload(wait time.Duration) {
+	log.Info(fmt.Sprintf("Delaying the reload command of %s by %s to respect min_reload_interval", t.Dest, wait))
+	t.delayed = t.pending
+	t.pending = nil
+	t.recordPending(time.Now().Add(wait))
+	if t.reloadTimer != nil {
+		t.reloadTimer.Stop()
+	}
+	t.reloadTimer = time.AfterFunc(wait, func() {
+		if err := t.process(); err != nil {
+			log.Error(err.Error())
+		}
+	})
+}
+
+// carryDelayedReloads hands the reloads put off by MinReloadInterval of the
+// closed resources in removed over to the resources of added that replace
+// them with the same dest, along with the time of their last reload so that
+// the interval still holds. It returns the resources that took one over,
+// which must be processed for it to run.
+func carryDelayedReloads(removed, added []*TemplateResource) []*TemplateResource {
+	replaced := make(map[string]*TemplateResource, len(removed))
+	for _, old := range removed {
+		replaced[old.name] = old
+	}
+	var carried []*TemplateResource
+	for _, t := range added {
+		old, ok := replaced[t.name]
+		if !ok || old.Dest != t.Dest {
+			continue
+		}
+		old.processMutex.Lock()
+		delayed := old.delayed
+		old.delayed = nil
+		old.processMutex.Unlock()
+		if delayed == nil {
+			continue
+		}
+		old.statusMutex.Lock()
+		last := old.status.LastReload
+		old.statusMutex.Unlock()
+		t.processMutex.Lock()
+		t.delayed = delayed
+		t.processMutex.Unlock()
+		t.statusMutex.Lock()
+		t.status.LastReload = last
+		t.statusMutex.Unlock()
+		log.Info("Carrying the delayed reload command of " + old.name + " over to its new definition")
+		carried = append(carried, t)
+	}
+	return carried
+}
@@ -0,0 +1,123 @@
+package template
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/backends/config-service/cfgsvctest"
+	"github.com/kelseyhightower/confd/log"
+)
+
+func TestMinReloadInterval(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	runs := filepath.Join(confDir, "runs")
+	tr := newRollbackResource(t, confDir, filepath.Join(confDir, "foo.conf"),
+		"reload_cmd = \"echo >> "+runs+"\"\nmin_reload_interval = 1\n")
+	defer tr.close()
+	defer os.Unsetenv("ROLLBACK_FOO")
+
+	for _, value := range []string{"a", "b", "c"} {
+		os.Setenv("ROLLBACK_FOO", value)
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		expectContents(t, tr.Dest, "foo = "+value)
+	}
+	// The first reload runs right away, the others are put off.
+	if n := countRuns(t, runs); n != 1 {
+		t.Errorf("Expected one reload, got %d", n)
+	}
+	if tr.Status().PendingUntil.IsZero() {
+		t.Error("Expected a pending reload")
+	}
+
+	// The delayed reload applies the latest dest.
+	time.Sleep(1500 * time.Millisecond)
+	if n := countRuns(t, runs); n != 2 {
+		t.Errorf("Expected two reloads, got %d", n)
+	}
+	if ok, err := tr.reloaded(); !ok || err != nil {
+		t.Errorf("Expected the reload to be recorded for the latest dest, got %v", err)
+	}
+	if s := tr.Status(); !s.PendingUntil.IsZero() {
+		t.Errorf("Expected no pending reload, got %s", s.PendingUntil)
+	}
+}
+
+func TestDelayedReloadCarriedOver(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	runs := filepath.Join(confDir, "runs")
+	dest := filepath.Join(confDir, "foo.conf")
+	cmds := "reload_cmd = \"echo >> " + runs + "\"\nmin_reload_interval = 1\n"
+	old := newRollbackResource(t, confDir, dest, cmds)
+	defer os.Unsetenv("ROLLBACK_FOO")
+	for _, value := range []string{"a", "b"} {
+		os.Setenv("ROLLBACK_FOO", value)
+		if err := old.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// The definition changes while the reload of "b" is put off.
+	tr := newRollbackResource(t, confDir, dest, cmds+"reload_timeout = 30\n")
+	defer tr.close()
+	closeAll([]*TemplateResource{old})
+	if carried := carryDelayedReloads([]*TemplateResource{old}, []*TemplateResource{tr}); len(carried) != 1 {
+		t.Fatalf("Expected the delayed reload to be carried over, got %d", len(carried))
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := countRuns(t, runs); n != 1 {
+		t.Errorf("Expected the carried reload to still wait for min_reload_interval, got %d reloads", n)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := countRuns(t, runs); n != 2 {
+		t.Errorf("Expected the carried reload to run, got %d reloads", n)
+	}
+	if ok, err := tr.reloaded(); !ok || err != nil {
+		t.Errorf("Expected the reload to be recorded for the latest dest, got %v", err)
+	}
+}
+
+func TestWatchProcessorDebounce(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("app", map[string]interface{}{"host": "h0"})
+
+	config, dest := setupConfigServiceResource(t, server,
+		"prefix = \"app\"\nkeys = [\"*\"]\ndebounce = 1\n", `host={{getv "/host"}}`)
+	defer os.RemoveAll(config.ConfDir)
+	p, stop := startWatchProcessor(t, config, 0)
+	defer stop()
+	waitForDest(t, dest, "host=h0", func() {})
+
+	// A burst of updates closer together than the debounce is rendered
+	// once it is over.
+	for i := 1; i <= 5; i++ {
+		server.SetBucket("app", map[string]interface{}{"host": fmt.Sprintf("h%d", i)})
+		time.Sleep(200 * time.Millisecond)
+		if contents, _ := ioutil.ReadFile(dest); string(contents) != "host=h0" {
+			t.Fatalf("Expected %s to be rendered after the burst, got %q", dest, contents)
+		}
+	}
+	if s := p.Status(); len(s) != 1 || s[0].PendingUntil.IsZero() {
+		t.Errorf("Expected a pending render, got %+v", s)
+	}
+	waitForDest(t, dest, "host=h5", func() {})
+}
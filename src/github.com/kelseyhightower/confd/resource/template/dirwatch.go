@@ -0,0 +1,220 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kelseyhightower/confd/log"
+)
+
+// resourceDirPollInterval is how often the template resource directories are
+// scanned for changes while they cannot be watched.
+var resourceDirPollInterval = 5 * time.Second
+
+// resourceDirSettleTime is how long the template resource directories must
+// be left alone after a change before it is reported, so that files still
+// being written are not loaded.
+var resourceDirSettleTime = 500 * time.Millisecond
+
+// WatchResourceDirs watches the template resource and template directories
+// of config and sends on the returned channel whenever a file in them is
+// added, changed or removed, until stopChan is closed. Directories that
+// cannot be watched, because they do not exist yet for instance, are polled
+// until they can.
+func WatchResourceDirs(config Config, stopChan chan bool) <-chan bool {
+	dirs := []string{config.ConfigDir, config.TemplateDir}
+	events := make(chan bool, 1)
+	// Watch, or scan, right away so that no change made after this returns
+	// is missed.
+	w, err := watchTrees(dirs)
+	var last map[string]string
+	if err != nil {
+		last = scanDirs(dirs)
+	}
+	go watchDirs(dirs, w, last, err, resourceDirPollInterval, events, stopChan)
+	changes := make(chan bool, 1)
+	go settle(events, changes, resourceDirSettleTime, stopChan)
+	return changes
+}
+
+// watchDirs sends on events whenever a file under dirs changes, until
+// stopChan is closed. It starts with w, or if watching dirs failed with err
+// with polling from the scan last, and polls again whenever one of dirs is
+// removed.
+func watchDirs(dirs []string, w *fsnotify.Watcher, last map[string]string, err error, interval time.Duration, events, stopChan chan bool) {
+	watch := func() (*fsnotify.Watcher, error) {
+		return watchTrees(dirs)
+	}
+	for {
+		if err != nil {
+			log.Warning(fmt.Sprintf("Cannot watch %s, polling them every %s until they can be watched: %s",
+				strings.Join(dirs, " and "), interval, err.Error()))
+			if w = pollDirs(dirs, last, interval, events, stopChan, watch); w == nil {
+				return
+			}
+			log.Info("Watching " + strings.Join(dirs, " and "))
+		}
+		if err = forwardEvents(w, dirs, events, stopChan); err == nil {
+			return
+		}
+		// The removed directory may be back already, so the first scan is
+		// reported as a change.
+		last = nil
+	}
+}
+
+// watchTrees returns a watcher of dirs and every directory below them.
+func watchTrees(dirs []string) (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if err := addTree(w, dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// addTree watches dir and every directory below it with w.
+func addTree(w *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return w.Add(path)
+	})
+}
+
+// forwardEvents sends on events for every event of w, and watches the
+// directories created under dirs, until stopChan is closed or one of dirs
+// is removed. It closes w and returns an error in the latter case.
+func forwardEvents(w *fsnotify.Watcher, dirs []string, events, stopChan chan bool) error {
+	defer w.Close()
+	for {
+		select {
+		case <-stopChan:
+			return nil
+		case e := <-w.Events:
+			notify(events)
+			if e.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(e.Name); err == nil && info.IsDir() {
+					if err := addTree(w, e.Name); err != nil {
+						log.Warning("Cannot watch new directory: " + err.Error())
+					}
+				}
+			}
+			if e.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && isOneOf(e.Name, dirs) {
+				return errors.New(e.Name + " was removed")
+			}
+		case err := <-w.Errors:
+			// Events may have been dropped, so look for changes anyway.
+			log.Warning("Error watching template resource directories: " + err.Error())
+			notify(events)
+		}
+	}
+}
+
+// isOneOf reports whether path is one of dirs.
+func isOneOf(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if filepath.Clean(dir) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// settle forwards events to changes once no event was received for
+// settleTime.
+func settle(events, changes chan bool, settleTime time.Duration, stopChan chan bool) {
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-events:
+		}
+	quiet:
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-events:
+			case <-time.After(settleTime):
+				break quiet
+			}
+		}
+		notify(changes)
+	}
+}
+
+// pollDirs scans dirs every interval and sends on events whenever a scan
+// differs from the previous one, starting with last. It also tries to watch
+// dirs with watch, and returns the watcher once that succeeds, or nil once
+// stopChan is closed.
+func pollDirs(dirs []string, last map[string]string, interval time.Duration, events, stopChan chan bool,
+	watch func() (*fsnotify.Watcher, error)) *fsnotify.Watcher {
+	for {
+		select {
+		case <-stopChan:
+			return nil
+		case <-time.After(interval):
+		}
+		w, err := watch()
+		// Scan once watching, so that no change is missed in between.
+		current := scanDirs(dirs)
+		if !sameScan(last, current) {
+			notify(events)
+		}
+		if err == nil {
+			return w
+		}
+		last = current
+	}
+}
+
+// scanDirs returns the size, mode and modification time of every file
+// under dirs, keyed by path. Missing directories are skipped.
+func scanDirs(dirs []string) map[string]string {
+	files := make(map[string]string)
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			files[path] = fmt.Sprintf("%d %s %d", info.Size(), info.Mode(), info.ModTime().UnixNano())
+			return nil
+		})
+	}
+	return files
+}
+
+func sameScan(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, v := range a {
+		if b[path] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// notify sends on c unless a notification is already pending.
+func notify(c chan bool) {
+	select {
+	case c <- true:
+	default:
+	}
+}
@@ -0,0 +1,202 @@
+package template
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kelseyhightower/confd/backends/config-service/cfgsvctest"
+	"github.com/kelseyhightower/confd/log"
+)
+
+func expectChange(t *testing.T, changes <-chan bool, what string) {
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a change after %s", what)
+	}
+}
+
+func testWatchResourceDirs(t *testing.T, changes <-chan bool, config Config) {
+	writeFile := func(path string) {
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	writeFile(filepath.Join(config.ConfigDir, "new.toml"))
+	expectChange(t, changes, "adding a template resource")
+
+	writeFile(filepath.Join(config.TemplateDir, "new.tmpl"))
+	expectChange(t, changes, "adding a template")
+
+	dir := filepath.Join(config.ConfigDir, "sub")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectChange(t, changes, "adding a directory")
+	writeFile(filepath.Join(dir, "nested.toml"))
+	expectChange(t, changes, "adding a template resource to a new directory")
+
+	os.Remove(filepath.Join(config.ConfigDir, "new.toml"))
+	expectChange(t, changes, "removing a template resource")
+}
+
+func TestWatchResourceDirs(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(d time.Duration) { resourceDirSettleTime = d }(resourceDirSettleTime)
+	resourceDirSettleTime = 10 * time.Millisecond
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	config := Config{ConfigDir: filepath.Join(confDir, "conf.d"), TemplateDir: filepath.Join(confDir, "templates")}
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	testWatchResourceDirs(t, WatchResourceDirs(config, stopChan), config)
+}
+
+func TestPollResourceDirs(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	config := Config{ConfigDir: filepath.Join(confDir, "conf.d"), TemplateDir: filepath.Join(confDir, "templates")}
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	changes := make(chan bool, 1)
+	dirs := []string{config.ConfigDir, config.TemplateDir}
+	unwatchable := func() (*fsnotify.Watcher, error) {
+		return nil, errors.New("cannot watch")
+	}
+	go pollDirs(dirs, scanDirs(dirs), 10*time.Millisecond, changes, stopChan, unwatchable)
+	testWatchResourceDirs(t, changes, config)
+}
+
+func TestWatchResourceDirsMissing(t *testing.T) {
+	log.SetLevel("error")
+	defer func(d time.Duration) { resourceDirSettleTime = d }(resourceDirSettleTime)
+	resourceDirSettleTime = 10 * time.Millisecond
+	defer func(d time.Duration) { resourceDirPollInterval = d }(resourceDirPollInterval)
+	resourceDirPollInterval = 10 * time.Millisecond
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	config := Config{ConfigDir: filepath.Join(confDir, "conf.d"), TemplateDir: filepath.Join(confDir, "templates")}
+	if err := os.RemoveAll(config.TemplateDir); err != nil {
+		t.Fatal(err.Error())
+	}
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	changes := WatchResourceDirs(config, stopChan)
+
+	// The directories are watched once the missing one is created.
+	if err := os.Mkdir(config.TemplateDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectChange(t, changes, "creating the missing directory")
+	testWatchResourceDirs(t, changes, config)
+
+	// And again once a watched directory is removed and recreated.
+	if err := os.RemoveAll(config.TemplateDir); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectChange(t, changes, "removing a watched directory")
+	if err := os.Mkdir(config.TemplateDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectChange(t, changes, "recreating a watched directory")
+	if err := ioutil.WriteFile(filepath.Join(config.TemplateDir, "app.tmpl"), nil, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectChange(t, changes, "adding a template to the recreated directory")
+}
+
+func TestPollResourceDirsWatch(t *testing.T) {
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	dirs := []string{filepath.Join(confDir, "conf.d"), filepath.Join(confDir, "missing")}
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	watchers := make(chan *fsnotify.Watcher, 1)
+	go func() {
+		watchers <- pollDirs(dirs, scanDirs(dirs), 10*time.Millisecond, make(chan bool, 1), stopChan, func() (*fsnotify.Watcher, error) {
+			return watchTrees(dirs)
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Mkdir(dirs[1], 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case w := <-watchers:
+		if w == nil {
+			t.Fatal("Expected a watcher of the directories")
+		}
+		w.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected polling to stop once the directories can be watched")
+	}
+}
+
+func TestIntervalProcessorResourceDirs(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(d time.Duration) { resourceDirSettleTime = d }(resourceDirSettleTime)
+	resourceDirSettleTime = 10 * time.Millisecond
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("app", map[string]interface{}{"host": "h1"})
+
+	config, dest := setupConfigServiceResource(t, server,
+		"prefix = \"app\"\nkeys = [\"host\"]\n",
+		`host={{getv "/host"}}`)
+	defer os.RemoveAll(config.ConfDir)
+	stopChan, doneChan := make(chan bool), make(chan bool)
+	defer func() {
+		close(stopChan)
+		<-doneChan
+	}()
+	p := IntervalProcessor(config, stopChan, doneChan, make(chan error, 10), 3600)
+	go p.Process()
+	waitForDest(t, dest, "host=h1", func() {})
+
+	changes := WatchResourceDirs(config, stopChan)
+	go func() {
+		for {
+			select {
+			case <-changes:
+				if err := p.Reload(config); err != nil {
+					log.Debug(err.Error())
+				}
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+
+	otherDest := filepath.Join(config.ConfDir, "other.conf")
+	err := ioutil.WriteFile(filepath.Join(config.ConfigDir, "other.toml"),
+		[]byte("[template]\nsrc = \"app.tmpl\"\ndest = \""+otherDest+"\"\nprefix = \"app\"\nkeys = [\"host\"]\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	waitForDest(t, otherDest, "host=h1", func() {})
+
+	err = ioutil.WriteFile(filepath.Join(config.TemplateDir, "app.tmpl"), []byte(`server={{getv "/host"}}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	waitForDest(t, dest, "server=h1", func() {})
+	waitForDest(t, otherDest, "server=h1", func() {})
+}
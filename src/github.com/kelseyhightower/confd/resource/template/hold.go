@@ -0,0 +1,252 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// holdPath returns the path of the file marking t as held.
+func (t *TemplateResource) holdPath() string {
+	return filepath.Join(t.reloadCmdMarkerDir, "held", t.name)
+}
+
+// canHold returns an error if t cannot be held, as holds are kept under
+// reload_cmd_marker_dir.
+func (t *TemplateResource) canHold() error {
+	if t.reloadCmdMarkerDir == "" {
+		return fmt.Errorf("%s cannot be held without reload_cmd_marker_dir", t.name)
+	}
+	return nil
+}
+
+// isHeld reports whether t was pinned to a backup by confd rollback, in
+// which case its dest must be left alone.
+func (t *TemplateResource) isHeld() bool {
+	if t.reloadCmdMarkerDir == "" {
+		return false
+	}
+	_, err := os.Stat(t.holdPath())
+	return err == nil
+}
+
+// lockHold takes an exclusive lock on the hold of t, waiting for it to be
+// released by another process. Rollback and Release hold it while they
+// change the hold, and confd while it checks the hold and writes the dest.
+// It returns a function releasing the lock and an error if any.
+func (t *TemplateResource) lockHold() (func(), error) {
+	if t.reloadCmdMarkerDir == "" {
+		return func() {}, nil
+	}
+	path := t.holdPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// The hold file itself comes and goes, so the lock is taken on a file
+	// next to it.
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Cannot lock the hold of %s: %s", t.name, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// lockHoldIfAny takes the lock on the hold of t like lockHold, but only if
+// a resource was ever held under reload_cmd_marker_dir, so that rendering
+// does not depend on that dir. A lock that cannot be taken is logged rather
+// than failing the render.
+// It returns a function releasing the lock.
+func (t *TemplateResource) lockHoldIfAny() func() {
+	if t.reloadCmdMarkerDir == "" {
+		return func() {}
+	}
+	if _, err := os.Stat(filepath.Dir(t.holdPath())); err != nil {
+		return func() {}
+	}
+	unlock, err := t.lockHold()
+	if err != nil {
+		log.Error(err.Error())
+		return func() {}
+	}
+	return unlock
+}
+
+// hold marks t as held at backup.
+// It returns an error if any.
+func (t *TemplateResource) hold(backup string) error {
+	if err := t.canHold(); err != nil {
+		return err
+	}
+	path := t.holdPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	contents := fmt.Sprintf("%s %s\n", backup, time.Now().UTC().Format(time.RFC3339))
+	return ioutil.WriteFile(path, []byte(contents), 0644)
+}
+
+// release lets t be rendered again.
+// It returns an error if any.
+func (t *TemplateResource) release() error {
+	return os.Remove(t.holdPath())
+}
+
+// Rollback restores version, one of the backups of the template resource
+// named name, to its dest and holds the resource there until it is
+// released. The most recent backup is restored if version is empty. The
+// backup must pass the check command, if set, and the reload command is
+// then run.
+// It returns the backup if it was restored, even if the reload command
+// failed, and an error if any.
+func Rollback(config Config, name, version string) (Backup, error) {
+	t, err := loadTemplateResource(filepath.Join(config.ConfigDir, name+".toml"), config)
+	if err != nil {
+		return Backup{}, err
+	}
+	if t.BackupDir == "" {
+		return Backup{}, fmt.Errorf("backups of %s are disabled, set backup_dir", name)
+	}
+	if err := t.canHold(); err != nil {
+		return Backup{}, err
+	}
+	backups, err := listBackups(t.backupDir())
+	if err != nil {
+		return Backup{}, err
+	}
+	var b Backup
+	for _, candidate := range backups {
+		if version == "" || candidate.Name == version {
+			b = candidate
+			break
+		}
+	}
+	if b.Name == "" {
+		if version == "" {
+			return Backup{}, fmt.Errorf("no backups of %s", name)
+		}
+		return Backup{}, fmt.Errorf("no backup %s of %s", version, name)
+	}
+	unlock, err := t.lockHold()
+	if err != nil {
+		return Backup{}, err
+	}
+	err = t.restoreBackup(b)
+	unlock()
+	if err != nil {
+		return Backup{}, err
+	}
+	log.Info("Restored " + b.Path + " to " + t.Dest)
+	if !t.reloads() && !t.verifies() {
+		return b, nil
+	}
+	err = t.reloadAndVerify()
+	if t.reloads() {
+		if serr := t.saveState(err, ""); serr != nil {
+			log.Error("Cannot save the state of " + t.name + ": " + serr.Error())
+		}
+	}
+	return b, err
+}
+
+// restoreBackup holds t and puts b in place of its dest once it passed the
+// check command. t is released again if b cannot be restored.
+// It returns an error if any.
+func (t *TemplateResource) restoreBackup(b Backup) (err error) {
+	// Hold t first so that a running confd does not render it while the
+	// backup is restored.
+	if err := t.hold(b.Name); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			t.release()
+		}
+	}()
+	if err := t.stageBackup(b); err != nil {
+		return err
+	}
+	defer os.Remove(t.StageFile.Name())
+	if t.CheckCmd != "" {
+		if err := t.check(); err != nil {
+			return errors.New("Config check failed: " + err.Error())
+		}
+	}
+	previous, err := t.copyDest()
+	if err != nil {
+		return err
+	}
+	// The dest is not backed up, so that the most recent backup is still
+	// the one to roll back to when confd rollback is run again.
+	if err := os.Rename(t.StageFile.Name(), t.Dest); err != nil {
+		return err
+	}
+	t.setReloadContext(previous)
+	return nil
+}
+
+// stageBackup copies b to the stage file of t, with its mode and owner.
+// It returns an error if any.
+func (t *TemplateResource) stageBackup(b Backup) error {
+	contents, err := ioutil.ReadFile(b.Path)
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(t.Dest), "."+filepath.Base(t.Dest))
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(contents)
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	os.Chmod(temp.Name(), b.Mode)
+	os.Chown(temp.Name(), b.Uid, b.Gid)
+	t.StageFile = temp
+	return nil
+}
+
+// Release lets the template resource named name, held by Rollback, be
+// rendered again, and the values rolled back for it be applied again.
+// It returns an error if any.
+func Release(config Config, name string) error {
+	t, err := loadTemplateResource(filepath.Join(config.ConfigDir, name+".toml"), config)
+	if err != nil {
+		return err
+	}
+	if err := t.canHold(); err != nil {
+		return err
+	}
+	unlock, err := t.lockHold()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	cleared, err := t.clearRejected()
+	if err != nil {
+		return err
+	}
+	if !t.isHeld() {
+		if cleared {
+			return nil
+		}
+		return fmt.Errorf("%s is neither held nor rolled back", name)
+	}
+	return t.release()
+}
@@ -0,0 +1,223 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/backends/env"
+	"github.com/kelseyhightower/confd/log"
+)
+
+// setupHoldResource returns the config of a template resource named foo
+// rendering "foo = <HOLD_FOO>" to the returned dest, with backups enabled.
+// CONFDIR in cmds is replaced with the confd conf directory.
+func setupHoldResource(t *testing.T, cmds string) (Config, string) {
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(confDir, "templates", "foo.tmpl"), []byte(`foo = {{getv "/hold/foo"}}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dest := filepath.Join(confDir, "foo.conf")
+	resource := "[template]\nsrc = \"foo.tmpl\"\ndest = \"" + dest + "\"\nkeys = [\"/hold/foo\"]\n" +
+		strings.Replace(cmds, "CONFDIR", confDir, -1)
+	if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", "foo.toml"), []byte(resource), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return Config{
+		BackupDir:          filepath.Join(confDir, "backups"),
+		ConfDir:            confDir,
+		ConfigDir:          filepath.Join(confDir, "conf.d"),
+		ReloadCmdMarkerDir: confDir,
+		StoreClient:        storeClient,
+		TemplateDir:        filepath.Join(confDir, "templates"),
+	}, dest
+}
+
+func renderHoldResource(t *testing.T, config Config, value string) *TemplateResource {
+	os.Setenv("HOLD_FOO", value)
+	tr, err := NewTemplateResource(filepath.Join(config.ConfigDir, "foo.toml"), config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return tr
+}
+
+func expectContents(t *testing.T, path, want string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(data) != want {
+		t.Errorf("Expected %s to hold %q, got %q", path, want, string(data))
+	}
+}
+
+func TestRollbackAndRelease(t *testing.T) {
+	log.SetLevel("warn")
+	config, dest := setupHoldResource(t, "reload_cmd = \"true\"\n")
+	defer os.RemoveAll(config.ConfDir)
+	defer os.Unsetenv("HOLD_FOO")
+	renderHoldResource(t, config, "good")
+	renderHoldResource(t, config, "bad")
+
+	b, err := Rollback(config, "foo", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if b.Name == "" {
+		t.Fatal("Expected the restored backup to be returned")
+	}
+	expectContents(t, dest, "foo = good")
+
+	// Renders leave a held dest alone.
+	tr := renderHoldResource(t, config, "worse")
+	expectContents(t, dest, "foo = good")
+	if s := tr.Status(); s.LastOutcome != OutcomeHeld || !s.Held {
+		t.Errorf("Expected the resource to be held, got %+v", s)
+	}
+
+	// The dest replaced by the rollback is not backed up, so rolling back
+	// again restores the same backup.
+	again, err := Rollback(config, "foo", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if again.Name != b.Name {
+		t.Errorf("Expected %s to be restored again, got %s", b.Name, again.Name)
+	}
+	expectContents(t, dest, "foo = good")
+	if _, err := Rollback(config, "foo", "missing"); err == nil {
+		t.Error("Expected a rollback to a missing backup to fail")
+	}
+
+	if err := Release(config, "foo"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Release(config, "foo"); err == nil {
+		t.Error("Expected releasing a resource that is not held to fail")
+	}
+	renderHoldResource(t, config, "worse")
+	expectContents(t, dest, "foo = worse")
+}
+
+func TestRollbackCheckFailed(t *testing.T) {
+	log.SetLevel("error")
+	config, dest := setupHoldResource(t, "check_cmd = \"test ! -e CONFDIR/reject\"\n")
+	defer os.RemoveAll(config.ConfDir)
+	defer os.Unsetenv("HOLD_FOO")
+	renderHoldResource(t, config, "good")
+	renderHoldResource(t, config, "bad")
+
+	if err := ioutil.WriteFile(filepath.Join(config.ConfDir, "reject"), nil, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := Rollback(config, "foo", ""); err == nil {
+		t.Fatal("Expected the rollback to fail the check command")
+	}
+	os.Remove(filepath.Join(config.ConfDir, "reject"))
+	expectContents(t, dest, "foo = bad")
+	renderHoldResource(t, config, "worse")
+	expectContents(t, dest, "foo = worse")
+}
+
+func TestRollbackWithoutMarkerDir(t *testing.T) {
+	log.SetLevel("warn")
+	config, dest := setupHoldResource(t, "")
+	defer os.RemoveAll(config.ConfDir)
+	defer os.Unsetenv("HOLD_FOO")
+	renderHoldResource(t, config, "good")
+	renderHoldResource(t, config, "bad")
+
+	// Holds are kept under reload_cmd_marker_dir, never relative to the
+	// working dir.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	workDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(workDir)
+	defer os.Chdir(wd)
+	if err := os.Chdir(workDir); err != nil {
+		t.Fatal(err.Error())
+	}
+	config.ReloadCmdMarkerDir = ""
+	if _, err := Rollback(config, "foo", ""); err == nil {
+		t.Error("Expected a rollback without reload_cmd_marker_dir to fail")
+	}
+	expectContents(t, dest, "foo = bad")
+	if isFileExist("held") {
+		t.Error("Expected no hold relative to the working dir")
+	}
+	if err := Release(config, "foo"); err == nil {
+		t.Error("Expected a release without reload_cmd_marker_dir to fail")
+	}
+}
+
+func TestHoldLockBlocksRender(t *testing.T) {
+	log.SetLevel("warn")
+	config, dest := setupHoldResource(t, "")
+	defer os.RemoveAll(config.ConfDir)
+	defer os.Unsetenv("HOLD_FOO")
+	tr := renderHoldResource(t, config, "good")
+
+	// confd rollback is between its check and its restore.
+	unlock, err := tr.lockHold()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Setenv("HOLD_FOO", "new")
+	done := make(chan error, 1)
+	go func() {
+		done <- tr.process()
+	}()
+	select {
+	case err := <-done:
+		unlock()
+		t.Fatalf("Expected the render to wait for the hold lock, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	expectContents(t, dest, "foo = good")
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+	expectContents(t, dest, "foo = new")
+}
+
+func TestRenderWithoutHoldDir(t *testing.T) {
+	log.SetLevel("fatal")
+	config, dest := setupHoldResource(t, "")
+	defer os.RemoveAll(config.ConfDir)
+	defer os.Unsetenv("HOLD_FOO")
+	// reload_cmd_marker_dir cannot be created, which only matters to holds.
+	notDir := filepath.Join(config.ConfDir, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config.ReloadCmdMarkerDir = filepath.Join(notDir, "markers")
+	renderHoldResource(t, config, "good")
+	expectContents(t, dest, "foo = good")
+
+	config.ReloadCmdMarkerDir = config.ConfDir
+	renderHoldResource(t, config, "new")
+	if isFileExist(filepath.Join(config.ConfDir, "held")) {
+		t.Error("Expected no hold dir to be created by a render")
+	}
+}
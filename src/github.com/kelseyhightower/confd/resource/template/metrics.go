@@ -0,0 +1,173 @@
+package template
+
+import (
+	"context"
+	"time"
+
+	"github.com/kelseyhightower/confd/backends"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rendersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confd_renders_total",
+		Help: "Number of times a template resource was processed.",
+	}, []string{"resource", "backend"})
+	renderErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confd_render_errors_total",
+		Help: "Number of times processing a template resource failed.",
+	}, []string{"resource", "backend"})
+	changesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confd_changes_total",
+		Help: "Number of times a dest file was updated.",
+	}, []string{"resource", "backend"})
+	checkFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confd_check_failures_total",
+		Help: "Number of times the check command failed.",
+	}, []string{"resource", "backend"})
+	reloadFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confd_reload_failures_total",
+		Help: "Number of times the reload command failed.",
+	}, []string{"resource", "backend"})
+	verifyFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confd_verify_failures_total",
+		Help: "Number of times the verify command failed.",
+	}, []string{"resource", "backend"})
+	rollbacksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confd_rollbacks_total",
+		Help: "Number of times a dest file was rolled back.",
+	}, []string{"resource", "backend"})
+	lastSuccessTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "confd_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful processing of a template resource.",
+	}, []string{"resource", "backend"})
+	watchedPrefixes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "confd_watched_prefixes",
+		Help: "Number of prefixes currently watched.",
+	}, []string{"backend"})
+	backendRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "confd_backend_request_duration_seconds",
+		Help: "Duration of backend calls.",
+		// Span from 5ms to 5m to cover both backend requests and
+		// long-polling watches.
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"resource", "backend", "call"})
+	backendErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confd_backend_errors_total",
+		Help: "Number of backend calls that failed.",
+	}, []string{"resource", "backend", "call"})
+	watchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "confd_watch_duration_seconds",
+		Help: "Duration of backend watches.",
+		// Watches are long polls, from a few milliseconds when a change
+		// is pending to the timeout of the backend.
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"prefix", "backend"})
+	watchErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "confd_watch_errors_total",
+		Help: "Number of backend watches that failed.",
+	}, []string{"prefix", "backend"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		rendersTotal,
+		renderErrorsTotal,
+		changesTotal,
+		checkFailuresTotal,
+		reloadFailuresTotal,
+		verifyFailuresTotal,
+		rollbacksTotal,
+		lastSuccessTimestamp,
+		watchedPrefixes,
+		backendRequestDuration,
+		backendErrorsTotal,
+		watchDuration,
+		watchErrorsTotal,
+	)
+}
+
+// resourceMetrics are the metrics labelled by template resource and backend.
+var resourceMetrics = []interface {
+	DeleteLabelValues(lvs ...string) bool
+}{
+	rendersTotal,
+	renderErrorsTotal,
+	changesTotal,
+	checkFailuresTotal,
+	reloadFailuresTotal,
+	verifyFailuresTotal,
+	rollbacksTotal,
+	lastSuccessTimestamp,
+}
+
+// meteredStoreClient records the duration and errors of every call made to
+// the backend on behalf of a template resource.
+type meteredStoreClient struct {
+	backends.StoreClient
+	resource string
+	backend  string
+}
+
+func (c *meteredStoreClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	start := time.Now()
+	vars, err := c.StoreClient.GetValues(ctx, keys)
+	backendRequestDuration.WithLabelValues(c.resource, c.backend, "GetValues").Observe(time.Since(start).Seconds())
+	if isBackendError(ctx, err) {
+		backendErrorsTotal.WithLabelValues(c.resource, c.backend, "GetValues").Inc()
+	}
+	return vars, err
+}
+
+// observeWatch records a watch of prefix that started at start and failed
+// with err, if not nil.
+func observeWatch(ctx context.Context, prefix, backend string, start time.Time, err error) {
+	watchDuration.WithLabelValues(prefix, backend).Observe(time.Since(start).Seconds())
+	if isBackendError(ctx, err) {
+		watchErrorsTotal.WithLabelValues(prefix, backend).Inc()
+	}
+}
+
+// isBackendError reports whether err, returned by a backend call made with
+// ctx, is a failure of the backend. Calls canceled by confd, on reload or
+// shutdown, are not. Backends may wrap the cancellation, so ask ctx.
+func isBackendError(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() != context.Canceled
+}
+
+// deleteWatchMetrics drops the series of the watch of prefix, once it is no
+// longer watched.
+func deleteWatchMetrics(prefix, backend string) {
+	watchDuration.DeleteLabelValues(prefix, backend)
+	watchErrorsTotal.DeleteLabelValues(prefix, backend)
+}
+
+// deleteRemovedMetrics drops the series of the resources of removed that are
+// not replaced by one of added, so that removed resources are not exported
+// forever.
+func deleteRemovedMetrics(added, removed []*TemplateResource) {
+	replaced := make(map[string]bool)
+	for _, t := range added {
+		replaced[t.name] = true
+	}
+	for _, t := range removed {
+		if replaced[t.name] {
+			continue
+		}
+		for _, m := range resourceMetrics {
+			m.DeleteLabelValues(t.name, t.backend)
+		}
+		backendRequestDuration.DeleteLabelValues(t.name, t.backend, "GetValues")
+		backendErrorsTotal.DeleteLabelValues(t.name, t.backend, "GetValues")
+	}
+}
+
+// recordMetrics updates the render metrics of t after it was processed.
+func (t *TemplateResource) recordMetrics(err error) {
+	rendersTotal.WithLabelValues(t.name, t.backend).Inc()
+	if err != nil {
+		renderErrorsTotal.WithLabelValues(t.name, t.backend).Inc()
+		return
+	}
+	lastSuccessTimestamp.WithLabelValues(t.name, t.backend).Set(float64(time.Now().Unix()))
+}
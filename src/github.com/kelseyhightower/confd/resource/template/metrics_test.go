@@ -0,0 +1,122 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/backends"
+	"github.com/kelseyhightower/confd/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricValue returns the value of the counter or gauge name with the given
+// label values, or the number of observations of the histogram name. It
+// reads the registered metrics, so that no series is created, and returns 0
+// if there is none.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Counter != nil:
+				return m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				return m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+type failingStoreClient struct {
+	backends.StoreClient
+}
+
+func (c failingStoreClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("unreachable")
+}
+
+func TestMeteredStoreClientErrors(t *testing.T) {
+	c := &meteredStoreClient{StoreClient: failingStoreClient{}, resource: "metered", backend: "fake"}
+	labels := map[string]string{"resource": "metered", "backend": "fake", "call": "GetValues"}
+	// The metrics are global, so start from no series when run again.
+	deleteRemovedMetrics(nil, []*TemplateResource{{name: "metered", backend: "fake"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.GetValues(ctx, []string{"/foo"})
+	if n := metricValue(t, "confd_backend_errors_total", labels); n != 0 {
+		t.Errorf("Expected a canceled call not to count as an error, got %v", n)
+	}
+	c.GetValues(context.Background(), []string{"/foo"})
+	if n := metricValue(t, "confd_backend_errors_total", labels); n != 1 {
+		t.Errorf("Expected 1 error, got %v", n)
+	}
+	if n := metricValue(t, "confd_backend_request_duration_seconds", labels); n != 2 {
+		t.Errorf("Expected 2 calls, got %v", n)
+	}
+}
+
+func TestWatchMetrics(t *testing.T) {
+	log.SetLevel("warn")
+	client := newFakeWatchClient()
+	m := newWatchMux(Config{StoreClient: client, Backend: "metered"}, make(chan error, 10))
+	a := &TemplateResource{name: "a", prefix: "/metered"}
+	labels := map[string]string{"prefix": "/metered", "backend": "metered"}
+
+	events := m.subscribe(a)
+	expectEvent(t, events, "a")
+	client.waitForWatches(t, "/metered", 1)
+	client.change("/metered")
+	expectEvent(t, events, "a")
+	if n := metricValue(t, "confd_watch_duration_seconds", labels); n < 2 {
+		t.Errorf("Expected at least 2 watches of the prefix, got %v", n)
+	}
+	if n := metricValue(t, "confd_backend_request_duration_seconds", map[string]string{"resource": "", "backend": "metered", "call": "WatchPrefix"}); n != 0 {
+		t.Errorf("Expected no watch to be recorded against an empty resource, got %v", n)
+	}
+
+	// The series go away with the watch.
+	m.unsubscribe(a)
+	for i := 0; metricValue(t, "confd_watch_duration_seconds", labels) != 0; i++ {
+		if i == 100 {
+			t.Fatal("Expected the watch series to be deleted once the prefix is no longer watched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeleteRemovedMetrics(t *testing.T) {
+	removed := []*TemplateResource{{name: "gone", backend: "fake"}, {name: "changed", backend: "fake"}}
+	added := []*TemplateResource{{name: "changed", backend: "fake"}}
+	deleteRemovedMetrics(nil, removed)
+	for _, tr := range removed {
+		tr.recordMetrics(nil)
+	}
+	deleteRemovedMetrics(added, removed)
+	if n := metricValue(t, "confd_renders_total", map[string]string{"resource": "gone", "backend": "fake"}); n != 0 {
+		t.Errorf("Expected the series of a removed resource to be deleted, got %v", n)
+	}
+	if n := metricValue(t, "confd_renders_total", map[string]string{"resource": "changed", "backend": "fake"}); n != 1 {
+		t.Errorf("Expected the series of a changed resource to be kept, got %v", n)
+	}
+}
@@ -0,0 +1,79 @@
+package template
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// taskCommLen is the length the kernel truncates process names to, with
+// the terminating null byte.
+const taskCommLen = 16
+
+// findProcesses returns the pids of the running processes named name,
+// leaving out those whose parent has the same name, such as the workers of
+// a master process.
+// It returns an error if there is none.
+func findProcesses(name string) ([]int, error) {
+	if len(name) >= taskCommLen {
+		name = name[:taskCommLen-1]
+	}
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int]int)
+	for _, stat := range stats {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		// Processes can exit while they are listed.
+		data, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		comm, state, ppid, ok := parseStat(string(data))
+		// Zombies have exited and are only waiting to be reaped.
+		if ok && comm == name && state != "Z" {
+			parents[pid] = ppid
+		}
+	}
+	var pids []int
+	for pid, ppid := range parents {
+		if _, ok := parents[ppid]; !ok {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process named %q is running", name)
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// parseStat returns the name, state and parent pid of a process from the
+// contents of its /proc/<pid>/stat.
+func parseStat(stat string) (comm, state string, ppid int, ok bool) {
+	// The name is in parentheses and may contain any character, so it
+	// ends at the last closing parenthesis.
+	start := strings.IndexByte(stat, '(')
+	end := strings.LastIndexByte(stat, ')')
+	if start < 0 || end < start {
+		return "", "", 0, false
+	}
+	// The state and the parent pid follow the name.
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 2 {
+		return "", "", 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", "", 0, false
+	}
+	return stat[start+1 : end], fields[0], ppid, true
+}
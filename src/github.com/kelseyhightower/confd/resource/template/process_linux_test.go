@@ -0,0 +1,62 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFindProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	// A copy of the shell gives the process a name of its own. Its
+	// subshell has the same name, but only the parent is signaled.
+	shell := filepath.Join(dir, "confdtestshell")
+	data, err := ioutil.ReadFile("/bin/sh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(shell, data, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	stop, hups, pidfile := startTrap(t, dir, shell)
+	defer stop()
+
+	pid, err := readPidfile(pidfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Wait for the subshell to start.
+	time.Sleep(100 * time.Millisecond)
+	pids, err := findProcesses("confdtestshell")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(pids) != 1 || pids[0] != pid {
+		t.Errorf("Expected pids [%d], got %v", pid, pids)
+	}
+	tr := &TemplateResource{ReloadSignal: "SIGHUP", ProcessName: "confdtestshell"}
+	if err := tr.reload(); err != nil {
+		t.Fatal(err.Error())
+	}
+	waitForRuns(t, hups, 1)
+
+	if _, err := findProcesses("confd-no-such-process"); err == nil {
+		t.Error("Expected an error for a process that is not running")
+	}
+}
+
+func TestParseStat(t *testing.T) {
+	comm, state, ppid, ok := parseStat("1234 (my (odd) name) S 42 1234 1234 0 -1")
+	if !ok || comm != "my (odd) name" || state != "S" || ppid != 42 {
+		t.Errorf("Expected \"my (odd) name\", S and 42, got %q, %s and %d", comm, state, ppid)
+	}
+	if _, _, _, ok := parseStat("1234 nginx"); ok {
+		t.Error("Expected an invalid stat to be rejected")
+	}
+}
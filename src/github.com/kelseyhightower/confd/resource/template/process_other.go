@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package template
+
+import "errors"
+
+// findProcesses is only implemented with /proc.
+func findProcesses(name string) ([]int, error) {
+	return nil, errors.New("process_name is only supported on Linux")
+}
@@ -2,14 +2,21 @@ package template
 
 import (
 	"fmt"
+	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/kelseyhightower/confd/backends"
 	"github.com/kelseyhightower/confd/log"
 )
 
 type Processor interface {
 	Process()
+	Status() []ResourceStatus
+	Trigger(name string) ([]TriggerResult, error)
+	Reload(config Config) error
+	RemoveStageFiles()
 }
 
 func Process(config Config) error {
@@ -17,21 +24,114 @@ func Process(config Config) error {
 	if err != nil {
 		return err
 	}
-	return process(ts)
+	return process(ts, config.Concurrency)
 }
 
-func process(ts []*TemplateResource) error {
-	var lastErr error
-	for _, t := range ts {
-		if err := t.process(); err != nil {
+// ProcessErrors holds the errors of every template resource that could not
+// be processed.
+type ProcessErrors []error
+
+func (e ProcessErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d template resources failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// process processes ts with up to concurrency resources at a time, at least
+// one. It returns ProcessErrors, in the order of ts, if any resource failed.
+func process(ts []*TemplateResource, concurrency int) error {
+	var failed ProcessErrors
+	for _, err := range processPass(ts, concurrency) {
+		if err != nil {
 			log.Error(err.Error())
-			lastErr = err
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
+
+// processPass processes ts, which must be distinct, in one pass with up to
+// concurrency resources at a time, at least one. Reload commands run once
+// every dest of the pass has been written, and only once for the resources
+// sharing one, see reloadKey. The outcome is recorded in the status of each
+// resource.
+// It returns the error of each resource, in the order of ts.
+func processPass(ts []*TemplateResource, concurrency int) []error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// Lock every resource for the render. Each resource is unlocked as soon
+	// as it is done with: after the render if it has no reload pending, else
+	// once its reload command ran. It is also unlocked while its reload
+	// command waits to be retried, see backoff.
+	lockAll(ts)
+
+	errs := make([]error, len(ts))
+	parallel(len(ts), concurrency, func(i int) {
+		t := ts[i]
+		if t.closed {
+			return
+		}
+		t.outcome = OutcomeUnchanged
+		t.pending = nil
+		t.recordPending(time.Time{})
+		errs[i] = t.processStages()
+	})
+	index := make(map[*TemplateResource]int, len(ts))
+	for i, t := range ts {
+		index[t] = i
+	}
+	// done records the outcome of t, which failed if its render or, failing
+	// that, its reload, verification or rollback did.
+	done := func(t *TemplateResource, applyErr error) {
+		defer t.processMutex.Unlock()
+		if t.closed {
+			return
+		}
+		err := errs[index[t]]
+		if err == nil {
+			err = applyErr
+		}
+		if err != nil && t.outcome == OutcomeUnchanged {
+			t.outcome = OutcomeError
+		}
+		t.recordRender(err)
+		t.recordMetrics(err)
+	}
+	groups := pendingReloads(ts)
+	for _, t := range ts {
+		if t.pending == nil {
+			done(t, nil)
 		}
 	}
-	return lastErr
+	finishReloads(groups, concurrency, done)
+	return errs
+}
+
+// parallel calls f for each of 0 to n-1 with up to concurrency calls at a
+// time, and waits for all of them to return.
+func parallel(n, concurrency int, f func(i int)) {
+	workers := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		workers <- true
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
 }
 
 type intervalProcessor struct {
+	resourceSet
 	config   Config
 	stopChan chan bool
 	doneChan chan bool
@@ -40,7 +140,14 @@ type intervalProcessor struct {
 }
 
 func IntervalProcessor(config Config, stopChan, doneChan chan bool, errChan chan error, interval int) Processor {
-	return &intervalProcessor{config, stopChan, doneChan, errChan, interval}
+	return &intervalProcessor{
+		resourceSet: resourceSet{concurrency: config.Concurrency},
+		config:      config,
+		stopChan:    stopChan,
+		doneChan:    doneChan,
+		errChan:     errChan,
+		interval:    interval,
+	}
 }
 
 func (p *intervalProcessor) Process() {
@@ -50,28 +157,85 @@ func (p *intervalProcessor) Process() {
 		log.Fatal(err.Error())
 		return
 	}
-	for {
-		process(ts)
-		select {
-		case <-p.stopChan:
-			break
-		case <-time.After(time.Duration(p.interval) * time.Second):
-			continue
+	p.update(ts)
+	go func() {
+		for {
+			process(p.list(), p.config.Concurrency)
+			select {
+			case <-p.stopChan:
+				return
+			case <-time.After(time.Duration(p.interval) * time.Second):
+			}
 		}
+	}()
+	<-p.stopChan
+	p.drain()
+}
+
+// Reload loads the template resources from config and processes the ones
+// that were added or changed right away. The running resources are kept if
+// any template resource cannot be loaded.
+func (p *intervalProcessor) Reload(config Config) error {
+	ts, err := reloadTemplateResources(config)
+	if err != nil {
+		return err
 	}
+	added, removed := p.update(ts)
+	logResourceChanges(added, removed)
+	closeAll(removed)
+	deleteRemovedMetrics(added, removed)
+	// The added resources are processed anyway, which runs the reloads
+	// carried over once they are due.
+	carryDelayedReloads(removed, added)
+	go process(added, p.config.Concurrency)
+	return nil
 }
 
+// batchWindow is how long the watch processor waits after a resource
+// changes for the other resources changed by the same update before it
+// processes them.
+var batchWindow = 500 * time.Millisecond
+
 type watchProcessor struct {
+	resourceSet
 	config   Config
 	stopChan chan bool
 	doneChan chan bool
 	errChan  chan error
 	wg       sync.WaitGroup
+	// resyncInterval is the number of seconds between full resyncs, or 0.
+	resyncInterval int
+
+	mux *watchMux
+
+	// batchMutex guards batch.
+	batchMutex sync.Mutex
+	// batch holds the resources that changed since the pass scheduled
+	// last started, see schedule.
+	batch []*TemplateResource
+
+	// watchMutex guards watches and stopped.
+	watchMutex sync.Mutex
+	// watches holds the channel that stops the watch of each resource.
+	watches map[*TemplateResource]chan bool
+	stopped bool
 }
 
-func WatchProcessor(config Config, stopChan, doneChan chan bool, errChan chan error) Processor {
-	var wg sync.WaitGroup
-	return &watchProcessor{config, stopChan, doneChan, errChan, wg}
+// WatchProcessor processes template resources whenever their prefix changes
+// in the backend. If resyncInterval is not 0, every template resource is also
+// processed about every resyncInterval seconds, to correct missed
+// notifications and dest files edited by hand.
+func WatchProcessor(config Config, stopChan, doneChan chan bool, errChan chan error, resyncInterval int) Processor {
+	return &watchProcessor{
+		resourceSet:    resourceSet{concurrency: config.Concurrency},
+		config:         config,
+		stopChan:       stopChan,
+		doneChan:       doneChan,
+		errChan:        errChan,
+		resyncInterval: resyncInterval,
+		mux:            newWatchMux(config, errChan),
+		watches:        make(map[*TemplateResource]chan bool),
+	}
 }
 
 func (p *watchProcessor) Process() {
@@ -81,31 +245,253 @@ func (p *watchProcessor) Process() {
 		log.Fatal(err.Error())
 		return
 	}
-	for _, t := range ts {
-		t := t
+	added, _ := p.update(ts)
+	p.startWatches(added)
+	if p.resyncInterval > 0 {
 		p.wg.Add(1)
-		go p.monitorPrefix(t)
+		go p.resync()
 	}
+	<-p.stopChan
+	p.stopAll()
+	p.drain()
 	p.wg.Wait()
 }
 
-func (p *watchProcessor) monitorPrefix(t *TemplateResource) {
+// resync processes every template resource every resyncInterval seconds,
+// plus up to a tenth of that so that many instances of confd do not hit the
+// backend at once. Resources are never processed concurrently, so a resync
+// waits for a render triggered by a watch and vice versa.
+func (p *watchProcessor) resync() {
+	defer p.wg.Done()
+	interval := time.Duration(p.resyncInterval) * time.Second
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		jitter := time.Duration(random.Int63n(int64(interval)/10 + 1))
+		select {
+		case <-p.stopChan:
+			return
+		case <-time.After(interval + jitter):
+		}
+		log.Debug("Resyncing all template resources")
+		process(p.list(), p.config.Concurrency)
+	}
+}
+
+// Reload loads the template resources from config, starts watching the ones
+// that were added or changed and stops watching the ones that were removed
+// or changed. The running resources are kept if any template resource
+// cannot be loaded.
+func (p *watchProcessor) Reload(config Config) error {
+	ts, err := reloadTemplateResources(config)
+	if err != nil {
+		return err
+	}
+	added, removed := p.update(ts)
+	logResourceChanges(added, removed)
+	p.stopWatches(removed)
+	closeAll(removed)
+	deleteRemovedMetrics(added, removed)
+	carried := carryDelayedReloads(removed, added)
+	p.startWatches(added)
+	p.watchMutex.Lock()
+	defer p.watchMutex.Unlock()
+	if !p.stopped {
+		for _, t := range carried {
+			p.schedule(t)
+		}
+	}
+	return nil
+}
+
+// startWatches starts a watch for each of ts, unless the processor is
+// stopping.
+func (p *watchProcessor) startWatches(ts []*TemplateResource) {
+	p.watchMutex.Lock()
+	defer p.watchMutex.Unlock()
+	if p.stopped {
+		return
+	}
+	for _, t := range ts {
+		stop := make(chan bool)
+		p.watches[t] = stop
+		p.wg.Add(1)
+		go p.monitorResource(t, stop)
+	}
+}
+
+// stopWatches stops the watch of each of ts.
+func (p *watchProcessor) stopWatches(ts []*TemplateResource) {
+	p.watchMutex.Lock()
+	defer p.watchMutex.Unlock()
+	for _, t := range ts {
+		if stop, ok := p.watches[t]; ok {
+			close(stop)
+			delete(p.watches, t)
+		}
+	}
+}
+
+// stopAll stops every watch and prevents new ones from being started.
+func (p *watchProcessor) stopAll() {
+	p.watchMutex.Lock()
+	defer p.watchMutex.Unlock()
+	p.stopped = true
+	for t, stop := range p.watches {
+		close(stop)
+		delete(p.watches, t)
+	}
+}
+
+// monitorResource processes t whenever its prefix changes until stop is
+// closed. If t has a debounce, it is processed once its prefix stopped
+// changing for that long.
+func (p *watchProcessor) monitorResource(t *TemplateResource, stop chan bool) {
 	defer p.wg.Done()
+	events := p.mux.subscribe(t)
+	defer p.mux.unsubscribe(t)
+	var quiet <-chan time.Time
 	for {
-		index, err := t.storeClient.WatchPrefix(t.prefix, t.lastIndex, p.stopChan)
+		select {
+		case <-stop:
+			return
+		case <-quiet:
+			quiet = nil
+			p.schedule(t)
+			continue
+		case <-events.ready:
+		}
+		e, ok := events.next()
+		if !ok {
+			continue
+		}
+		// Errors are reported by the mux, once for all the resources
+		// sharing the prefix.
+		if backends.IsPrefixDeleted(e.err) {
+			if !p.bucketDeleted(t) {
+				return
+			}
+			continue
+		}
+		t.setBackendError(e.err)
+		if e.err != nil {
+			continue
+		}
+		if t.Debounce > 0 {
+			debounce := time.Duration(t.Debounce) * time.Second
+			t.recordPending(time.Now().Add(debounce))
+			quiet = time.After(debounce)
+			continue
+		}
+		p.schedule(t)
+	}
+}
+
+// schedule processes t in a pass with the other resources that change within
+// batchWindow, so that they share their reload commands.
+func (p *watchProcessor) schedule(t *TemplateResource) {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+	for _, b := range p.batch {
+		if b == t {
+			return
+		}
+	}
+	if len(p.batch) == 0 {
+		p.wg.Add(1)
+		time.AfterFunc(batchWindow, p.processBatch)
+	}
+	p.batch = append(p.batch, t)
+}
+
+// processBatch processes the resources scheduled so far in one pass.
+func (p *watchProcessor) processBatch() {
+	defer p.wg.Done()
+	p.batchMutex.Lock()
+	ts := p.batch
+	p.batch = nil
+	p.batchMutex.Unlock()
+	// Resources are watched independently, so they are processed all at
+	// once rather than limited by the concurrency.
+	for _, err := range processPass(ts, len(ts)) {
 		if err != nil {
 			p.errChan <- err
-			// Prevent backend errors from consuming all resources.
-			time.Sleep(time.Second * 2)
+		}
+	}
+}
+
+// bucketDeleted applies the on_bucket_deleted policy of t. t is rendered
+// again once the bucket is recreated.
+// It returns false if t should no longer be watched.
+func (p *watchProcessor) bucketDeleted(t *TemplateResource) bool {
+	var err error
+	switch t.OnBucketDeleted {
+	case BucketDeletedFail:
+		p.errChan <- fmt.Errorf("Stopped watching %s after its bucket was deleted", t.Dest)
+		return false
+	case BucketDeletedRenderEmpty:
+		log.Info("Rendering " + t.Dest + " without values after its bucket was deleted")
+		err = t.renderEmpty()
+	case BucketDeletedRemoveDest:
+		err = t.removeDest()
+	default:
+		log.Info("Keeping " + t.Dest + " after its bucket was deleted")
+	}
+	if err != nil {
+		p.errChan <- err
+	}
+	return true
+}
+
+// logResourceChanges logs the template resources added, removed and changed
+// by a reload.
+func logResourceChanges(added, removed []*TemplateResource) {
+	changed := make(map[string]bool)
+	for _, t := range removed {
+		changed[t.name] = true
+	}
+	for _, t := range added {
+		if changed[t.name] {
+			log.Info("Updating template resource " + t.name)
+			delete(changed, t.name)
 			continue
 		}
-		t.lastIndex = index
-		if err := t.process(); err != nil {
-			p.errChan <- err
+		log.Info("Adding template resource " + t.name)
+	}
+	for _, t := range removed {
+		if changed[t.name] {
+			log.Info("Removing template resource " + t.name)
 		}
 	}
 }
 
+// closeAll closes ts. Every retry is stopped first so that resources are
+// not waited on one retry after another.
+func closeAll(ts []*TemplateResource) {
+	for _, t := range ts {
+		t.stopRetrying()
+	}
+	for _, t := range ts {
+		t.close()
+	}
+}
+
+// reloadTemplateResources loads the template resources from config on a
+// reload. Unlike at startup, a missing confdir or a conf.d without template
+// resources is an error, so that a mistake does not drop every resource.
+func reloadTemplateResources(config Config) ([]*TemplateResource, error) {
+	if !isFileExist(config.ConfDir) {
+		return nil, fmt.Errorf("Cannot load template resources: confdir '%s' does not exist", config.ConfDir)
+	}
+	ts, err := getTemplateResources(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(ts) == 0 {
+		return nil, fmt.Errorf("Cannot load template resources: no template resource in '%s'", config.ConfigDir)
+	}
+	return ts, nil
+}
+
 func getTemplateResources(config Config) ([]*TemplateResource, error) {
 	var lastError error
 	templates := make([]*TemplateResource, 0)
@@ -0,0 +1,430 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/backends/config-service"
+	"github.com/kelseyhightower/confd/backends/config-service/cfgsvctest"
+	"github.com/kelseyhightower/confd/backends/env"
+	"github.com/kelseyhightower/confd/log"
+)
+
+// setupConfigServiceResource writes a template resource rendering tmpl from
+// the given config-service buckets and returns the confd Config and dest.
+func setupConfigServiceResource(t *testing.T, server *cfgsvctest.Server, resource, tmpl string) (Config, string) {
+	tempConfDir, err := createTempDirs()
+	if err != nil {
+		t.Fatalf("Failed to create temp dirs: %s", err.Error())
+	}
+	dest := filepath.Join(tempConfDir, "app.conf")
+	err = ioutil.WriteFile(filepath.Join(tempConfDir, "templates", "app.tmpl"), []byte(tmpl), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resource = "[template]\nsrc = \"app.tmpl\"\ndest = \"" + dest + "\"\n" + resource
+	err = ioutil.WriteFile(filepath.Join(tempConfDir, "conf.d", "app.toml"), []byte(resource), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient, err := config_service.NewConfigClient(nil, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return Config{
+		Backend:     "config-service",
+		ConfDir:     tempConfDir,
+		ConfigDir:   filepath.Join(tempConfDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(tempConfDir, "templates"),
+	}, dest
+}
+
+// startWatchProcessor runs a WatchProcessor for config and returns it along
+// with a function stopping it.
+func startWatchProcessor(t *testing.T, config Config, resyncInterval int) (Processor, func()) {
+	stopChan := make(chan bool)
+	doneChan := make(chan bool)
+	errChan := make(chan error)
+	go func() {
+		for err := range errChan {
+			log.Debug(err.Error())
+		}
+	}()
+	p := WatchProcessor(config, stopChan, doneChan, errChan, resyncInterval)
+	go p.Process()
+	return p, func() {
+		close(stopChan)
+		select {
+		case <-doneChan:
+		case <-time.After(10 * time.Second):
+			t.Error("WatchProcessor did not stop")
+		}
+	}
+}
+
+// waitForDest applies change until the contents of dest are want, or dest
+// is missing if want is empty. change is repeated because a change made
+// before the watch is set up would go unnoticed.
+func waitForDest(t *testing.T, dest, want string, change func()) {
+	deadline := time.Now().Add(10 * time.Second)
+	var got string
+	for time.Now().Before(deadline) {
+		change()
+		time.Sleep(100 * time.Millisecond)
+		contents, err := ioutil.ReadFile(dest)
+		if want == "" && os.IsNotExist(err) {
+			return
+		}
+		got = string(contents)
+		if err == nil && got == want {
+			return
+		}
+	}
+	t.Fatalf("Expected contents of dest == %q, got %q", want, got)
+}
+
+func TestWatchProcessorConfigService(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("app", map[string]interface{}{"host": "h1", "port": 80})
+	server.SetBucket("app-overrides", map[string]interface{}{"port": 8080})
+
+	config, dest := setupConfigServiceResource(t, server,
+		"prefix = \"app,app-overrides\"\nkeys = [\"*\"]\n",
+		`host={{getv "/host"}} port={{getv "/port"}}`)
+	defer os.RemoveAll(config.ConfDir)
+	_, stop := startWatchProcessor(t, config, 0)
+	defer stop()
+
+	waitForDest(t, dest, "host=h1 port=8080", func() {})
+	waitForDest(t, dest, "host=h2 port=8080", func() {
+		server.SetBucket("app", map[string]interface{}{"host": "h2", "port": 80})
+	})
+	waitForDest(t, dest, "host=h2 port=80", func() {
+		server.SetBucket("app-overrides", map[string]interface{}{})
+	})
+}
+
+func TestProcessorStatus(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("app", map[string]interface{}{"host": "h1"})
+
+	config, dest := setupConfigServiceResource(t, server,
+		"prefix = \"app\"\nkeys = [\"host\"]\nreload_cmd = \"true\"\n",
+		`host={{getv "/host"}}`)
+	defer os.RemoveAll(config.ConfDir)
+	config.ReloadCmdMarkerDir = config.ConfDir
+	// Metrics are global, so only count what this test adds.
+	labels := map[string]string{"resource": "app", "backend": "config-service", "call": "GetValues"}
+	changes := metricValue(t, "confd_changes_total", labels)
+	getValues := metricValue(t, "confd_backend_request_duration_seconds", labels)
+	p := IntervalProcessor(config, make(chan bool), make(chan bool), make(chan error, 10), 3600)
+	go p.Process()
+	waitForDest(t, dest, "host=h1", func() {})
+
+	var status ResourceStatus
+	for i := 0; i < 100; i++ {
+		if statuses := p.Status(); len(statuses) == 1 && !statuses[0].LastRender.IsZero() {
+			status = statuses[0]
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if status.Name != "app" || status.Dest != dest {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	fi, err := fileStat(dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if status.DestHash != fi.Md5 {
+		t.Errorf("Expected dest hash %s, got %s", fi.Md5, status.DestHash)
+	}
+	if status.ReloadResult != "ok" || status.LastReload.IsZero() {
+		t.Errorf("Expected a successful reload, got %+v", status)
+	}
+	if n := metricValue(t, "confd_changes_total", labels) - changes; n != 1 {
+		t.Errorf("Expected 1 change, got %v", n)
+	}
+	if n := metricValue(t, "confd_backend_request_duration_seconds", labels) - getValues; n != 1 {
+		t.Errorf("Expected 1 GetValues call, got %v", n)
+	}
+}
+
+func TestWatchProcessorBucketDeleted(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(d time.Duration) { bucketRecreatePollInterval = d }(bucketRecreatePollInterval)
+	bucketRecreatePollInterval = 50 * time.Millisecond
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("app", map[string]interface{}{"host": "h1"})
+
+	config, dest := setupConfigServiceResource(t, server,
+		"prefix = \"app\"\nkeys = [\"host\"]\non_bucket_deleted = \"remove_dest\"\n",
+		`host={{getv "/host"}}`)
+	defer os.RemoveAll(config.ConfDir)
+	_, stop := startWatchProcessor(t, config, 0)
+	defer stop()
+
+	waitForDest(t, dest, "host=h1", func() {})
+	waitForDest(t, dest, "", func() {
+		server.DeleteBucket("app")
+	})
+	waitForDest(t, dest, "host=h2", func() {
+		server.SetBucket("app", map[string]interface{}{"host": "h2"})
+	})
+}
+
+func TestWatchProcessorReload(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("app", map[string]interface{}{"host": "h1"})
+
+	config, dest := setupConfigServiceResource(t, server,
+		"prefix = \"app\"\nkeys = [\"host\"]\n",
+		`host={{getv "/host"}}`)
+	defer os.RemoveAll(config.ConfDir)
+	p, stop := startWatchProcessor(t, config, 0)
+	defer stop()
+	waitForDest(t, dest, "host=h1", func() {})
+
+	writeFile := func(path, contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	reload := func() {
+		if err := p.Reload(config); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	names := func() []string {
+		var names []string
+		for _, s := range p.Status() {
+			names = append(names, s.Name)
+		}
+		return names
+	}
+
+	// A changed template is rendered again and keeps being watched.
+	writeFile(filepath.Join(config.TemplateDir, "app.tmpl"), `server={{getv "/host"}}`)
+	reload()
+	waitForDest(t, dest, "server=h1", func() {})
+	waitForDest(t, dest, "server=h2", func() {
+		server.SetBucket("app", map[string]interface{}{"host": "h2"})
+	})
+
+	// A new resource is rendered.
+	otherDest := filepath.Join(config.ConfDir, "other.conf")
+	writeFile(filepath.Join(config.ConfigDir, "other.toml"),
+		"[template]\nsrc = \"app.tmpl\"\ndest = \""+otherDest+"\"\nprefix = \"app\"\nkeys = [\"host\"]\n")
+	reload()
+	waitForDest(t, otherDest, "server=h2", func() {})
+	if got := names(); !reflect.DeepEqual(got, []string{"app", "other"}) {
+		t.Errorf("Expected resources [app other], got %v", got)
+	}
+
+	// A resource that cannot be loaded keeps the running ones.
+	writeFile(filepath.Join(config.ConfigDir, "broken.toml"), "[template")
+	if err := p.Reload(config); err == nil {
+		t.Error("Expected Reload to fail on an invalid template resource")
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{"app", "other"}) {
+		t.Errorf("Expected resources [app other], got %v", got)
+	}
+	os.Remove(filepath.Join(config.ConfigDir, "broken.toml"))
+
+	// A missing confdir or an empty conf.d keeps the running resources.
+	missing := config
+	missing.ConfDir = filepath.Join(config.ConfDir, "missing")
+	missing.ConfigDir = filepath.Join(missing.ConfDir, "conf.d")
+	if err := p.Reload(missing); err == nil {
+		t.Error("Expected Reload to fail on a missing confdir")
+	}
+	empty := config
+	empty.ConfigDir = filepath.Join(config.ConfDir, "empty")
+	os.Mkdir(empty.ConfigDir, 0755)
+	if err := p.Reload(empty); err == nil {
+		t.Error("Expected Reload to fail on a conf.d without template resources")
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{"app", "other"}) {
+		t.Errorf("Expected resources [app other], got %v", got)
+	}
+
+	// A removed resource is closed and no longer watched.
+	removed := p.(*watchProcessor).list()[0]
+	os.Remove(filepath.Join(config.ConfigDir, "app.toml"))
+	reload()
+	if got := names(); !reflect.DeepEqual(got, []string{"other"}) {
+		t.Errorf("Expected resources [other], got %v", got)
+	}
+	removed.processMutex.Lock()
+	if !removed.closed {
+		t.Error("Expected the removed resource to be closed")
+	}
+	removed.processMutex.Unlock()
+	waitForDest(t, otherDest, "server=h3", func() {
+		server.SetBucket("app", map[string]interface{}{"host": "h3"})
+	})
+	if contents, _ := ioutil.ReadFile(dest); string(contents) != "server=h2" {
+		t.Errorf("Expected removed resource to keep %q, got %q", "server=h2", contents)
+	}
+}
+
+func TestWatchProcessorResync(t *testing.T) {
+	log.SetLevel("warn")
+	server := cfgsvctest.NewServer()
+	defer server.Close()
+	server.SetBucket("app", map[string]interface{}{"host": "h1"})
+
+	config, dest := setupConfigServiceResource(t, server,
+		"prefix = \"app\"\nkeys = [\"host\"]\n",
+		`host={{getv "/host"}}`)
+	defer os.RemoveAll(config.ConfDir)
+	_, stop := startWatchProcessor(t, config, 1)
+	defer stop()
+	waitForDest(t, dest, "host=h1", func() {})
+
+	// A dest edited by hand does not change the bucket, so only a resync
+	// restores it.
+	if err := ioutil.WriteFile(dest, []byte("edited"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	waitForDest(t, dest, "host=h1", func() {})
+	waitForDest(t, dest, "host=h2", func() {
+		server.SetBucket("app", map[string]interface{}{"host": "h2"})
+	})
+}
+
+func TestProcessConcurrency(t *testing.T) {
+	log.SetLevel("warn")
+	tempConfDir, err := createTempDirs()
+	if err != nil {
+		t.Fatalf("Failed to create temp dirs: %s", err.Error())
+	}
+	defer os.RemoveAll(tempConfDir)
+	err = ioutil.WriteFile(filepath.Join(tempConfDir, "templates", "foo.tmpl"), []byte(`foo = {{getv "/concurrency/foo"}}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Every resource takes a second to check and the last one is rejected.
+	for _, name := range []string{"a", "b", "c", "d"} {
+		checkCmd := "sleep 1"
+		if name == "d" {
+			checkCmd = "sleep 1; exit 3"
+		}
+		resource := "[template]\nsrc = \"foo.tmpl\"\ndest = \"" + filepath.Join(tempConfDir, name+".conf") +
+			"\"\nkeys = [\"/concurrency/foo\"]\ncheck_cmd = \"" + checkCmd + "\"\n"
+		err = ioutil.WriteFile(filepath.Join(tempConfDir, "conf.d", name+".toml"), []byte(resource), 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	os.Setenv("CONCURRENCY_FOO", "bar")
+	defer os.Unsetenv("CONCURRENCY_FOO")
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts, err := getTemplateResources(Config{
+		ConfDir:     tempConfDir,
+		ConfigDir:   filepath.Join(tempConfDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(tempConfDir, "templates"),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	start := time.Now()
+	err = process(ts, 4)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected resources to be processed in parallel, took %s", elapsed)
+	}
+	errs, ok := err.(ProcessErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("Expected one error, got %v", err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if !isFileExist(filepath.Join(tempConfDir, name+".conf")) {
+			t.Errorf("Expected %s to be rendered", name)
+		}
+	}
+}
+
+func TestIntervalProcessorShutdown(t *testing.T) {
+	log.SetLevel("warn")
+	tempConfDir, err := createTempDirs()
+	if err != nil {
+		t.Fatalf("Failed to create temp dirs: %s", err.Error())
+	}
+	defer os.RemoveAll(tempConfDir)
+	err = ioutil.WriteFile(filepath.Join(tempConfDir, "templates", "foo.tmpl"), []byte(`foo = {{getv "/shutdown/foo"}}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// a is being reloaded when confd shuts down, and the reload command of
+	// b fails and would be retried.
+	reloaded := filepath.Join(tempConfDir, "reloaded")
+	reloadCmds := map[string]string{"a": "sleep 1; touch " + reloaded, "b": "exit 3"}
+	for name, reloadCmd := range reloadCmds {
+		resource := "[template]\nsrc = \"foo.tmpl\"\ndest = \"" + filepath.Join(tempConfDir, name+".conf") +
+			"\"\nkeys = [\"/shutdown/foo\"]\nreload_cmd = \"" + reloadCmd + "\"\n"
+		err = ioutil.WriteFile(filepath.Join(tempConfDir, "conf.d", name+".toml"), []byte(resource), 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// A stage file left behind by an earlier run.
+	leftover := filepath.Join(tempConfDir, ".a.conf4242")
+	if err := ioutil.WriteFile(leftover, nil, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Setenv("SHUTDOWN_FOO", "bar")
+	defer os.Unsetenv("SHUTDOWN_FOO")
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stopChan := make(chan bool)
+	doneChan := make(chan bool)
+	p := IntervalProcessor(Config{
+		Concurrency:        2,
+		ConfDir:            tempConfDir,
+		ConfigDir:          filepath.Join(tempConfDir, "conf.d"),
+		ReloadCmdMarkerDir: tempConfDir,
+		StoreClient:        storeClient,
+		TemplateDir:        filepath.Join(tempConfDir, "templates"),
+	}, stopChan, doneChan, make(chan error, 10), 3600)
+	go p.Process()
+	waitForDest(t, filepath.Join(tempConfDir, "a.conf"), "foo = bar", func() {})
+
+	close(stopChan)
+	select {
+	case <-doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("IntervalProcessor did not stop")
+	}
+	if !isFileExist(reloaded) {
+		t.Error("Expected the reload command in progress to complete")
+	}
+	if isFileExist(leftover) {
+		t.Error("Expected the leftover stage file to be removed")
+	}
+	os.Setenv("SHUTDOWN_FOO", "baz")
+	if _, err := p.Trigger("a"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(tempConfDir, "a.conf")); string(contents) != "foo = bar" {
+		t.Errorf("Expected no processing after shutdown, got %q", contents)
+	}
+}
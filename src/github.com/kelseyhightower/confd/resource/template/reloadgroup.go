@@ -0,0 +1,424 @@
+package template
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// pendingReload is a reload command left by sync to the end of the pass, so
+// that it runs once for every resource sharing it.
+type pendingReload struct {
+	// previous is the dest replaced by sync, or nil if the dest was already
+	// in sync but the reload command had not run for it yet.
+	previous *previousDest
+}
+
+// reloadGroup is a set of template resources sharing one run of the reload
+// command of the first of them.
+type reloadGroup []*TemplateResource
+
+// reloadKey returns the key shared by the resources whose reload command
+// runs once per pass: the reload group of t if set, else its reload signal,
+// or its rendered reload command along with the settings it runs with. Only
+// resources retrying the reload the same way share it.
+// It returns "" if t has no reload command to share.
+func (t *TemplateResource) reloadKey() string {
+	policy := fmt.Sprintf("\x00%d %d %d", t.ReloadRetries, t.ReloadBackoff, t.ReloadTimeout)
+	switch {
+	case !t.reloads():
+		return ""
+	case t.ReloadGroup != "":
+		return "group " + t.ReloadGroup + policy
+	case t.ReloadSignal != "":
+		return "signal " + t.ReloadSignal + " " + t.Pidfile + t.ProcessName + policy
+	default:
+		// The command gets the variables of every resource sharing it, see
+		// reloadEnv.
+		cmd, err := t.reloadCommand()
+		if err != nil {
+			return ""
+		}
+		return "command " + cmd + "\x00" + t.commandSettings() + policy
+	}
+}
+
+// pendingReloads groups the resources of ts with a pending reload by their
+// reload key, in the order of ts.
+func pendingReloads(ts []*TemplateResource) []reloadGroup {
+	var groups []reloadGroup
+	index := make(map[string]int)
+	for _, t := range ts {
+		if t.pending == nil {
+			continue
+		}
+		key := t.reloadKey()
+		if i, ok := index[key]; ok && key != "" {
+			groups[i] = append(groups[i], t)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, reloadGroup{t})
+	}
+	return groups
+}
+
+// reload executes the reload command, or sends the reload signal, once for
+// every member of g and records the result for each of them.
+// It returns nil if the reload command returns 0.
+func (g reloadGroup) reload() error {
+	t := g[0]
+	var err error
+	if t.ReloadSignal != "" {
+		err = t.signal()
+	} else {
+		var cmd string
+		if cmd, err = t.reloadCommand(); err != nil {
+			return g.recordReload(err)
+		}
+		log.Debug("Running " + cmd)
+		c := t.shellCommand(cmd, t.reloadCtx)
+		c.Env = g.reloadEnv()
+		var output []byte
+		output, err = run(c, time.Duration(t.ReloadTimeout)*time.Second)
+		if err != nil {
+			log.Error(fmt.Sprintf("%q", string(output)))
+		} else {
+			log.Debug(fmt.Sprintf("%q", string(output)))
+		}
+	}
+	return g.recordReload(err)
+}
+
+// reloadEnv returns the environment of the reload command of g, shared by
+// a reload group or by the same command. The variables of the change hold a
+// line for each member, in the order of g, except CONFD_CHANGED_KEYS, which
+// holds the keys changed for any of them.
+func (g reloadGroup) reloadEnv() []string {
+	t := g[0]
+	if len(g) == 1 {
+		return t.commandEnv(t.reloadCtx)
+	}
+	var srcs, dests, names, oldHashes, newHashes, states []string
+	changed := make(map[string]bool)
+	for _, m := range g {
+		c := m.reloadCtx
+		srcs = append(srcs, c.src)
+		dests = append(dests, m.Dest)
+		names = append(names, m.name)
+		oldHashes = append(oldHashes, c.oldHash)
+		newHashes = append(newHashes, c.newHash)
+		states = append(states, m.statePath())
+		for _, k := range m.changedKeys {
+			changed[k] = true
+		}
+	}
+	keys := make([]string, 0, len(changed))
+	for k := range changed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return append(t.baseEnv(),
+		"CONFD_SRC="+strings.Join(srcs, "\n"),
+		"CONFD_DEST="+strings.Join(dests, "\n"),
+		"CONFD_RESOURCE="+strings.Join(names, "\n"),
+		"CONFD_OLD_HASH="+strings.Join(oldHashes, "\n"),
+		"CONFD_NEW_HASH="+strings.Join(newHashes, "\n"),
+		"CONFD_CHANGED_KEYS="+strings.Join(keys, "\n"),
+		"CONFD_STATE="+strings.Join(states, "\n"),
+	)
+}
+
+// recordReload records err, the outcome of the reload command, for each
+// member of g and returns it.
+func (g reloadGroup) recordReload(err error) error {
+	for _, m := range g {
+		m.recordReload(err)
+		if err != nil {
+			reloadFailuresTotal.WithLabelValues(m.name, m.backend).Inc()
+		}
+	}
+	return err
+}
+
+// reloadWithRetry runs the reload command of g, retrying it up to
+// ReloadRetries times ReloadBackoff seconds apart while it fails, following
+// the policy of the first member. The members are held throughout.
+// It returns the error of the last attempt if all of them failed.
+func (g reloadGroup) reloadWithRetry() error {
+	t := g[0]
+	err := g.reload()
+	for i := 0; err != nil && i < t.ReloadRetries; i++ {
+		if !sleep(t, time.Duration(t.ReloadBackoff)*time.Second) {
+			log.Warning("Not retrying the reload command of " + g.dests() + ": confd is shutting down")
+			return err
+		}
+		log.Info(fmt.Sprintf("Retrying the reload command of %s (%d/%d)", g.dests(), i+1, t.ReloadRetries))
+		err = g.reload()
+	}
+	return err
+}
+
+// reloadRun is the pending reload of a reload group within a pass.
+type reloadRun struct {
+	g reloadGroup
+	// err is the error of the last attempt of the reload command.
+	err error
+	// retries is the number of times the reload command was retried.
+	retries int
+	// due is when the reload command is due to be retried.
+	due time.Time
+	// pending and outcomes are those of the members while they are
+	// released, see backoff.
+	pending  []*pendingReload
+	outcomes []Outcome
+}
+
+// attempt runs the reload command of r if it is due, unless confd is
+// stopping and the command was already run.
+// It returns whether the reload command must be retried.
+func (r *reloadRun) attempt(stopping bool) bool {
+	t := r.g[0]
+	if !t.reloads() {
+		return false
+	}
+	switch {
+	case r.due.IsZero():
+		if len(r.g) > 1 {
+			log.Info(fmt.Sprintf("Running the reload command once for %s", r.g.dests()))
+		}
+	case stopping:
+		log.Warning("Not retrying the reload command of " + r.g.dests() + ": confd is shutting down")
+		return false
+	case time.Now().Before(r.due):
+		return true
+	default:
+		log.Info(fmt.Sprintf("Retrying the reload command of %s (%d/%d)", r.g.dests(), r.retries, t.ReloadRetries))
+	}
+	r.err = r.g.reload()
+	if r.err == nil || r.retries == t.ReloadRetries {
+		return false
+	}
+	r.retries++
+	r.due = time.Now().Add(time.Duration(t.ReloadBackoff) * time.Second)
+	return true
+}
+
+// finishReloads runs the pending reload of each of groups, up to
+// concurrency groups at a time, then verifies the members and rolls back
+// the ones that were rejected, see finish. The members must be held, and
+// are the only resources the pass still holds. done is called for each
+// member once the pass is done with it, along with the error of its
+// reload, verification or rollback. The members that reloaded too recently
+// are put off, see delay.
+// While reload commands wait to be retried, their members are released,
+// see backoff.
+func finishReloads(groups []reloadGroup, concurrency int, done func(*TemplateResource, error)) {
+	var runs []*reloadRun
+	for _, g := range groups {
+		due := g.delay()
+		for _, t := range g.without(due) {
+			done(t, nil)
+		}
+		if len(due) > 0 {
+			runs = append(runs, &reloadRun{g: due})
+		}
+	}
+	stopping := false
+	for len(runs) > 0 {
+		retry := make([]bool, len(runs))
+		parallel(len(runs), concurrency, func(i int) {
+			r := runs[i]
+			if retry[i] = r.attempt(stopping); retry[i] {
+				return
+			}
+			errs := r.g.finish(r.err)
+			for j, t := range r.g {
+				done(t, errs[j])
+			}
+		})
+		var retrying []*reloadRun
+		for i, r := range runs {
+			if retry[i] {
+				retrying = append(retrying, r)
+			}
+		}
+		if len(retrying) == 0 {
+			return
+		}
+		runs, stopping = backoff(retrying)
+	}
+}
+
+// backoff waits until the first of runs is due to be retried without
+// holding their members, so that they can be rendered, triggered or closed
+// in the meantime. The pass holds no other resource by then, and takes
+// all the members back at once, in the order of lockAll, so that passes
+// sharing resources cannot deadlock. The reload of each member is put off
+// meanwhile, so that a pass processing the member again takes it over
+// along with the dest to roll back to, see setPending. The members whose
+// reload was taken over are released for good.
+// It returns the runs whose reload is still pending, and whether confd is
+// shutting down.
+func backoff(runs []*reloadRun) ([]*reloadRun, bool) {
+	var members reloadGroup
+	first := runs[0].due
+	for _, r := range runs {
+		if r.due.Before(first) {
+			first = r.due
+		}
+		r.pending = make([]*pendingReload, len(r.g))
+		r.outcomes = make([]Outcome, len(r.g))
+		for i, t := range r.g {
+			r.pending[i], r.outcomes[i] = t.pending, t.outcome
+			t.delayed = t.pending
+			members = append(members, t)
+		}
+	}
+	for _, t := range members {
+		t.processMutex.Unlock()
+	}
+	stopping := !sleep(members[0], time.Until(first))
+	lockAll(members)
+	var current []*reloadRun
+	for _, r := range runs {
+		var g reloadGroup
+		for i, t := range r.g {
+			if t.closed || t.delayed != r.pending[i] {
+				// The pass that took the reload over records it.
+				t.processMutex.Unlock()
+				continue
+			}
+			t.delayed, t.pending, t.outcome = nil, r.pending[i], r.outcomes[i]
+			g = append(g, t)
+		}
+		if len(g) < len(r.g) {
+			log.Info("Not retrying the reload command of " + r.g.without(g).dests() + ": it was taken over by another pass")
+		}
+		if len(g) > 0 {
+			r.g = g
+			current = append(current, r)
+		}
+	}
+	return current, stopping
+}
+
+// sleep waits for d, unless confd shuts down first.
+// It returns false if confd is shutting down.
+func sleep(t *TemplateResource, d time.Duration) bool {
+	select {
+	case <-t.context().Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// lockAll holds each of ts, always in the same order so that passes
+// sharing resources cannot deadlock.
+func lockAll(ts []*TemplateResource) {
+	locked := make([]*TemplateResource, len(ts))
+	copy(locked, ts)
+	sort.Slice(locked, func(i, j int) bool {
+		return locked[i].name < locked[j].name
+	})
+	for _, t := range locked {
+		t.processMutex.Lock()
+	}
+}
+
+// reloadAndFinish runs the pending reload of the members of g, holding them
+// throughout, then finishes it, see finish. The members that reloaded too
+// recently are put off, see delay.
+func (g reloadGroup) reloadAndFinish() {
+	if g = g.delay(); len(g) == 0 {
+		return
+	}
+	var err error
+	if g[0].reloads() {
+		err = g.reloadWithRetry()
+	}
+	g.finish(err)
+}
+
+// finish verifies each member of g once the reload command ran with err,
+// and rolls back the ones that were rejected. The members must be held.
+// It returns the error of the reload, verification or rollback of each
+// member, in the order of g.
+func (g reloadGroup) finish(err error) []error {
+	errs := make([]error, len(g))
+	var rejected reloadGroup
+	var indexes []int
+	var previous []*previousDest
+	var causes []error
+	for i, t := range g {
+		pending := t.pending
+		verr := t.verifyReload(err)
+		errs[i] = verr
+		if t.reloads() {
+			// A rejected reload is recorded too, so that it runs again.
+			if err := t.saveState(verr, t.keyFingerprint()); err != nil {
+				log.Error("Cannot save the state of " + t.name + ": " + err.Error())
+			}
+		}
+		if verr != nil {
+			log.Error(verr.Error())
+			// A dest that was in sync has nothing to roll back to.
+			if pending.previous != nil {
+				rejected = append(rejected, t)
+				indexes = append(indexes, i)
+				previous = append(previous, pending.previous)
+				causes = append(causes, verr)
+			}
+			continue
+		}
+		if pending.previous != nil {
+			log.Info("Target config " + t.Dest + " has been updated")
+		}
+	}
+	if len(rejected) > 0 {
+		for j, rerr := range rejected.rollback(previous, causes) {
+			if rerr != nil {
+				i := indexes[j]
+				errs[i] = fmt.Errorf("%s, and cannot roll back: %s", errs[i].Error(), rerr.Error())
+			}
+		}
+	}
+	for _, t := range g {
+		t.pending = nil
+	}
+	return errs
+}
+
+// contains reports whether t is a member of g.
+func (g reloadGroup) contains(t *TemplateResource) bool {
+	for _, m := range g {
+		if m == t {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns the members of g that are not members of other.
+func (g reloadGroup) without(other reloadGroup) reloadGroup {
+	var members reloadGroup
+	for _, t := range g {
+		if !other.contains(t) {
+			members = append(members, t)
+		}
+	}
+	return members
+}
+
+// dests returns the dests of the members of g for logging.
+func (g reloadGroup) dests() string {
+	s := g[0].Dest
+	for _, t := range g[1:] {
+		s += ", " + t.Dest
+	}
+	return s
+}
@@ -0,0 +1,306 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// countRuns returns how many times a command appending a line to path ran.
+func countRuns(t *testing.T, path string) int {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestReloadGroup(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	runs := filepath.Join(confDir, "runs")
+	grouped := filepath.Join(confDir, "grouped")
+
+	var ts []*TemplateResource
+	for _, r := range []struct {
+		name string
+		cmds string
+	}{
+		{"a", "reload_cmd = \"echo \\\"$CONFD_RESOURCE\\\" \\\"$CONFD_DEST\\\" >> " + runs + "\"\n"},
+		{"b", "reload_cmd = \"echo \\\"$CONFD_RESOURCE\\\" \\\"$CONFD_DEST\\\" >> " + runs + "\"\n"},
+		// A reload group shares the command of its first member.
+		{"c", "reload_cmd = \"echo \\\"$CONFD_RESOURCE\\\" >> " + grouped + "\"\nreload_group = \"web\"\n"},
+		{"d", "reload_cmd = \"echo d >> " + grouped + "\"\nreload_group = \"web\"\n"},
+	} {
+		ts = append(ts, newRollbackResource(t, confDir, filepath.Join(confDir, r.name+".conf"), r.cmds))
+	}
+	if err := process(ts, 1); err != nil {
+		t.Fatal(err.Error())
+	}
+	// The same command runs once, with the variables of every resource.
+	expectContents(t, runs, "a\nb "+ts[0].Dest+"\n"+ts[1].Dest+"\n")
+	// A reload group runs once with the variables of every member.
+	expectContents(t, grouped, "c\nd\n")
+	for _, tr := range ts {
+		s := tr.Status()
+		if s.LastOutcome != OutcomeUpdated || s.ReloadResult != "ok" || s.LastReload.IsZero() {
+			t.Errorf("%s: expected an updated dest and a successful reload, got %+v", tr.Dest, s)
+		}
+		if ok, err := tr.reloaded(); !ok || err != nil {
+			t.Errorf("%s: expected the reload to be recorded, got %v", tr.Dest, err)
+		}
+	}
+}
+
+func TestReloadKey(t *testing.T) {
+	a := &TemplateResource{name: "a", Dest: "/a", ReloadCmd: "nginx -s reload"}
+	b := &TemplateResource{name: "b", Dest: "/b", ReloadCmd: "nginx -s reload"}
+	if a.reloadKey() != b.reloadKey() {
+		t.Error("Expected the same reload command to be shared")
+	}
+	b.WorkingDir = "/tmp"
+	if a.reloadKey() == b.reloadKey() {
+		t.Error("Expected a reload command to be shared only by resources running it the same way")
+	}
+	b.WorkingDir = ""
+	a.ReloadGroup, b.ReloadGroup = "web", "web"
+	if a.reloadKey() != b.reloadKey() {
+		t.Error("Expected a reload group to be shared")
+	}
+	b.ReloadRetries = 1
+	if a.reloadKey() == b.reloadKey() {
+		t.Error("Expected a reload group to be shared only by resources retrying it the same way")
+	}
+}
+
+func TestReloadGroupRollback(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	runs := filepath.Join(confDir, "runs")
+	a := filepath.Join(confDir, "a.conf")
+	b := filepath.Join(confDir, "b.conf")
+	for _, dest := range []string{a, b} {
+		if err := ioutil.WriteFile(dest, []byte("foo = old"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// The service only accepts the old configs.
+	cmds := "reload_cmd = \"echo >> " + runs + "; grep -q old " + a + " && grep -q old " + b + "\"\n"
+	ts := []*TemplateResource{
+		newRollbackResource(t, confDir, a, cmds),
+		newRollbackResource(t, confDir, b, cmds),
+	}
+	if err := process(ts, 2); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Once for the new configs and once for the previous ones.
+	if n := countRuns(t, runs); n != 2 {
+		t.Errorf("Expected the shared reload command to run twice, ran %d times", n)
+	}
+	for _, tr := range ts {
+		expectContents(t, tr.Dest, "foo = old")
+		if s := tr.Status(); s.LastOutcome != OutcomeReloadFailed || s.RollbackResult != "ok" {
+			t.Errorf("%s: expected a rolled back reload failure, got %+v", tr.Dest, s)
+		}
+	}
+}
+
+func TestWatchProcessorBatch(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	runs := filepath.Join(confDir, "runs")
+	defer func(window time.Duration) { batchWindow = window }(batchWindow)
+	batchWindow = 100 * time.Millisecond
+
+	cmds := "reload_cmd = \"echo >> " + runs + "\"\n"
+	a := newRollbackResource(t, confDir, filepath.Join(confDir, "a.conf"), cmds)
+	b := newRollbackResource(t, confDir, filepath.Join(confDir, "b.conf"), cmds)
+	p := &watchProcessor{errChan: make(chan error, 10)}
+	p.wg.Add(1)
+	p.schedule(a)
+	p.schedule(b)
+	p.schedule(a)
+	p.wg.Done()
+	p.wg.Wait()
+	if n := countRuns(t, runs); n != 1 {
+		t.Errorf("Expected the reload command to run once for the batch, ran %d times", n)
+	}
+	for _, tr := range []*TemplateResource{a, b} {
+		expectContents(t, tr.Dest, "foo = new")
+	}
+	select {
+	case err := <-p.errChan:
+		t.Error(err.Error())
+	default:
+	}
+}
+
+func TestProcessPassReleasesResources(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	// The reload command of a runs until release is created.
+	release := filepath.Join(confDir, "release")
+	slow := newRollbackResource(t, confDir, filepath.Join(confDir, "a.conf"),
+		"reload_cmd = \"while [ ! -e "+release+" ]; do sleep 0.05; done\"\n")
+	fast := newRollbackResource(t, confDir, filepath.Join(confDir, "b.conf"), "")
+	done := make(chan bool)
+	go func() {
+		processPass([]*TemplateResource{slow, fast}, 2)
+		close(done)
+	}()
+	defer func() {
+		ioutil.WriteFile(release, nil, 0644)
+		<-done
+	}()
+
+	// b has no reload command, so it is released once rendered while the
+	// reload command of a still runs.
+	processed := make(chan error)
+	go func() {
+		for fast.Status().LastRender.IsZero() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		processed <- fast.process()
+	}()
+	select {
+	case err := <-processed:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected b to be processed again while the reload command of a runs")
+	}
+	select {
+	case <-done:
+		t.Error("Expected the reload command of a to still run")
+	default:
+	}
+}
+
+func TestReloadRetryReleasesResources(t *testing.T) {
+	log.SetLevel("fatal")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	runs := filepath.Join(confDir, "runs")
+	ok := filepath.Join(confDir, "ok")
+	// The reload command fails until ok is created, and is retried after
+	// a while.
+	tr := newRollbackResource(t, confDir, filepath.Join(confDir, "a.conf"),
+		"reload_cmd = \"echo >> "+runs+" && test -e "+ok+"\"\nreload_backoff = 3\n")
+	tr.ReloadRetries = 1
+	done := make(chan bool)
+	go func() {
+		processPass([]*TemplateResource{tr}, 1)
+		close(done)
+	}()
+	for countRuns(t, runs) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The resource can be processed while its reload command waits to be
+	// retried, and that pass takes the reload over.
+	if err := ioutil.WriteFile(ok, nil, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	processed := make(chan error)
+	go func() {
+		processed <- tr.process()
+	}()
+	select {
+	case err := <-processed:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the resource to be processed while its reload command waits to be retried")
+	}
+	<-done
+	if n := countRuns(t, runs); n != 2 {
+		t.Errorf("Expected the reload command not to be retried once taken over, ran %d times", n)
+	}
+	if s := tr.Status(); s.LastOutcome != OutcomeUnchanged || s.ReloadResult != "ok" {
+		t.Errorf("Expected the successful reload of the second pass to be kept, got %+v", s)
+	}
+	expectContents(t, tr.Dest, "foo = new")
+	if ok, err := tr.reloaded(); !ok || err != nil {
+		t.Errorf("Expected the reload to be recorded as successful, got %v", err)
+	}
+}
+
+func TestReloadRetryOverlappingPasses(t *testing.T) {
+	log.SetLevel("fatal")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	runs := filepath.Join(confDir, "runs")
+	var ts []*TemplateResource
+	for _, name := range []string{"a", "c"} {
+		tr := newRollbackResource(t, confDir, filepath.Join(confDir, name+".conf"),
+			"reload_cmd = \"echo "+name+" >> "+runs+"; false\"\nreload_backoff = 1\n")
+		tr.ReloadRetries = 2
+		ts = append(ts, tr)
+	}
+	// Each pass holds one of the resources while the reload command of the
+	// other one waits to be retried.
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() {
+			processPass(ts, 1)
+			done <- true
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(20 * time.Second):
+			t.Fatal("Expected overlapping passes retrying reload commands to finish")
+		}
+	}
+	for _, tr := range ts {
+		if s := tr.Status(); s.ReloadResult == "ok" {
+			t.Errorf("Expected the reload of %s to fail, got %+v", tr.Dest, s)
+		}
+	}
+}
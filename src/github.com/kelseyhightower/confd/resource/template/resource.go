@@ -2,6 +2,8 @@ package template
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +13,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
 
 	"github.com/BurntSushi/toml"
@@ -21,6 +25,16 @@ import (
 )
 
 type Config struct {
+	Backend       string
+	// BackupDir is where dest files are saved before they are replaced,
+	// or empty not to save them.
+	BackupDir     string
+	// BackupKeep is how many backups of each dest are kept, or 0 to keep
+	// all of them.
+	BackupKeep    int
+	// Concurrency is the number of template resources processed at once
+	// by interval and onetime runs and by resyncs.
+	Concurrency   int
 	ConfDir       string
 	ConfigDir     string
 	KeepStageFile bool
@@ -38,44 +52,150 @@ type TemplateResourceConfig struct {
 
 // TemplateResource is the representation of a parsed template resource.
 type TemplateResource struct {
+	// BackupDir and BackupKeep override those of Config.
+	BackupDir     string `toml:"backup_dir"`
+	BackupKeep    int    `toml:"backup_keep"`
 	CheckCmd      string `toml:"check_cmd"`
 	Dest          string
 	FileMode      os.FileMode
 	Gid           int
 	Keys          []string
 	Mode          string
+	OnBucketDeleted string `toml:"on_bucket_deleted"`
 	Prefix        string
 	ReloadCmd     string `toml:"reload_cmd"`
+	// ReloadCmdTemplate makes the reload command a template of the
+	// command variables, like the check command.
+	ReloadCmdTemplate bool `toml:"reload_cmd_template"`
+	// ReloadSignal is sent instead of running a reload command to the
+	// process whose pid is in Pidfile, or to the processes named
+	// ProcessName.
+	ReloadSignal  string `toml:"reload_signal"`
+	Pidfile       string `toml:"pidfile"`
+	ProcessName   string `toml:"process_name"`
+	// ReloadGroup names the resources that share one run of the reload
+	// command per pass. It defaults to the rendered reload command.
+	ReloadGroup   string `toml:"reload_group"`
+	// VerifyCmd and VerifyHTTP are run after the reload command to check
+	// that the service works with the new config.
+	VerifyCmd     string      `toml:"verify_cmd"`
+	VerifyHTTP    *VerifyHTTP `toml:"verify_http"`
+	// VerifyFailsReload makes a failed verification count as a failed
+	// reload, which rolls the dest back. It defaults to whether VerifyCmd
+	// is set, so that a failed verify_http alone is only reported.
+	VerifyFailsReload bool `toml:"verify_fails_reload"`
+	// ReloadRetries is how many times a failed reload command is retried.
+	ReloadRetries int `toml:"reload_retries"`
+	// ReloadBackoff is the number of seconds to wait between attempts.
+	ReloadBackoff int `toml:"reload_backoff"`
+	// ReloadTimeout is the number of seconds after which an attempt is
+	// killed, or 0 to wait for it indefinitely.
+	ReloadTimeout int `toml:"reload_timeout"`
+	// RunAsUser and RunAsGroup are the user and group, by name or id, the
+	// check, reload and verify commands run as, with WorkingDir as their
+	// working dir. Env is added to their environment, which is cleared
+	// first if ClearEnv is set.
+	RunAsUser     string            `toml:"run_as_user"`
+	RunAsGroup    string            `toml:"run_as_group"`
+	WorkingDir    string            `toml:"working_dir"`
+	Env           map[string]string `toml:"env"`
+	ClearEnv      bool              `toml:"clear_env"`
+	// Debounce is the number of seconds the prefix must stay unchanged
+	// before the watch processor renders the resource.
+	Debounce int `toml:"debounce"`
+	// MinReloadInterval is the minimum number of seconds between two runs
+	// of the reload command. A reload due sooner is delayed, not dropped.
+	MinReloadInterval int `toml:"min_reload_interval"`
 	Src           string
 	StageFile     *os.File
 	Uid           int
 	funcMap       map[string]interface{}
-	lastIndex     uint64
 	keepStageFile bool
+	name          string
+	backend       string
+	fingerprint   string
 	noop          bool
 	prefix        string
 	store         memkv.Store
 	storeClient   backends.StoreClient
 	reloadCmdMarkerDir string
+	status        ResourceStatus
+	statusMutex   sync.Mutex
+	outcome       Outcome
+	// values are the values of the latest render, and changedKeys the
+	// keys whose values it changed.
+	values        map[string]string
+	changedKeys   []string
+	// credential is the resolved RunAsUser and RunAsGroup, or nil.
+	credential    *syscall.Credential
+	// reloadCtx is the change the next reload command runs for.
+	reloadCtx     cmdContext
+	// pending is the reload left by sync to the end of the pass, or nil.
+	pending       *pendingReload
+	// delayed is the reload put off by MinReloadInterval, or nil, and
+	// reloadTimer processes the resource again once it is due.
+	delayed       *pendingReload
+	reloadTimer   *time.Timer
+	// processMutex ensures a resource is never processed concurrently.
+	processMutex  sync.Mutex
+	// closed is set, with processMutex held, once t must no longer be
+	// processed.
+	closed        bool
+	// ctx is canceled when confd shuts down to abort the backend calls and
+	// stop retrying the reload command.
+	ctx           context.Context
+	cancel        context.CancelFunc
 }
 
 var ErrEmptySrc = errors.New("empty src template")
 
+// Defaults of the reload command retry policy.
+const (
+	defaultReloadRetries = 9
+	defaultReloadBackoff = 20
+	defaultReloadTimeout = 60
+)
+
+// Policies applied by the watch processor when a config-service bucket
+// backing a template resource is deleted.
+const (
+	// BucketDeletedKeep leaves the rendered dest in place.
+	BucketDeletedKeep = "keep"
+	// BucketDeletedRenderEmpty renders the template without any values.
+	BucketDeletedRenderEmpty = "render_empty"
+	// BucketDeletedRemoveDest deletes the dest and runs the reload command.
+	BucketDeletedRemoveDest = "remove_dest"
+	// BucketDeletedFail reports an error and stops watching the resource.
+	BucketDeletedFail = "fail"
+)
+
 // NewTemplateResource creates a TemplateResource.
 func NewTemplateResource(path string, config Config) (*TemplateResource, error) {
 	if config.StoreClient == nil {
 		return nil, errors.New("A valid StoreClient is required.")
 	}
+	return loadTemplateResource(path, config)
+}
+
+// loadTemplateResource creates a TemplateResource, which may have no
+// StoreClient.
+func loadTemplateResource(path string, config Config) (*TemplateResource, error) {
 	var tc *TemplateResourceConfig
 	log.Debug("Loading template resource from " + path)
-	_, err := toml.DecodeFile(path, &tc)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
+	}
+	md, err := toml.Decode(string(data), &tc)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
 	}
 	tr := tc.TemplateResource
+	tr.name = resourceName(config.ConfigDir, path)
 	tr.keepStageFile = config.KeepStageFile
 	tr.noop = config.Noop
-	tr.storeClient = config.StoreClient
+	tr.backend = config.Backend
+	tr.storeClient = &meteredStoreClient{config.StoreClient, tr.name, config.Backend}
 	tr.funcMap = newFuncMap()
 	tr.store = memkv.New()
 	addFuncs(tr.funcMap, tr.store.FuncMap)
@@ -84,23 +204,89 @@ func NewTemplateResource(path string, config Config) (*TemplateResource, error)
 		return nil, ErrEmptySrc
 	}
 	tr.Src = filepath.Join(config.TemplateDir, tr.Src)
+	switch tr.OnBucketDeleted {
+	case "":
+		tr.OnBucketDeleted = BucketDeletedKeep
+	case BucketDeletedKeep, BucketDeletedRenderEmpty, BucketDeletedRemoveDest, BucketDeletedFail:
+	default:
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid on_bucket_deleted %q", path, tr.OnBucketDeleted)
+	}
+	if !md.IsDefined("template", "reload_retries") {
+		tr.ReloadRetries = defaultReloadRetries
+	}
+	if !md.IsDefined("template", "reload_backoff") {
+		tr.ReloadBackoff = defaultReloadBackoff
+	}
+	if !md.IsDefined("template", "reload_timeout") {
+		tr.ReloadTimeout = defaultReloadTimeout
+	}
+	if tr.ReloadRetries < 0 || tr.ReloadBackoff < 0 || tr.ReloadTimeout < 0 {
+		return nil, fmt.Errorf("Cannot process template resource %s - reload_retries, reload_backoff and reload_timeout must not be negative", path)
+	}
+	if tr.ReloadSignal != "" {
+		if err := tr.checkReloadSignal(); err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
+		}
+	}
+	if err := tr.setCredential(); err != nil {
+		return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
+	}
+	if tr.Debounce < 0 || tr.MinReloadInterval < 0 {
+		return nil, fmt.Errorf("Cannot process template resource %s - debounce and min_reload_interval must not be negative", path)
+	}
+	if tr.BackupDir == "" {
+		tr.BackupDir = config.BackupDir
+	}
+	if !md.IsDefined("template", "backup_keep") {
+		tr.BackupKeep = config.BackupKeep
+	}
+	if tr.BackupKeep < 0 {
+		return nil, fmt.Errorf("Cannot process template resource %s - backup_keep must not be negative", path)
+	}
+	if tr.VerifyHTTP != nil {
+		if err := tr.VerifyHTTP.setDefaults(md); err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
+		}
+	}
 	tr.reloadCmdMarkerDir = config.ReloadCmdMarkerDir
+	tr.fingerprint = fingerprint(data, tr.Src, config)
+	tr.ctx, tr.cancel = context.WithCancel(context.Background())
 	return &tr, nil
 }
 
+// fingerprint identifies the definition of a template resource: its TOML,
+// its template and the confd settings it depends on. Reloading the
+// configuration replaces a resource only if its fingerprint changed.
+func fingerprint(data []byte, src string, config Config) string {
+	h := md5.New()
+	h.Write(data)
+	if tmpl, err := ioutil.ReadFile(src); err == nil {
+		h.Write(tmpl)
+	}
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%t\x00%t\x00%s\x00%d", config.Backend, config.Prefix,
+		config.TemplateDir, config.ReloadCmdMarkerDir, config.KeepStageFile, config.Noop,
+		config.BackupDir, config.BackupKeep)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 // setVars sets the Vars for template resource.
 func (t *TemplateResource) setVars() error {
 	var err error
 	log.Debug("Retrieving keys from store")
 	log.Debug("Key prefix set to " + t.prefix)
-	result, err := t.storeClient.GetValues(appendPrefix(t.prefix, t.Keys))
+	result, err := t.storeClient.GetValues(t.context(), appendPrefix(t.prefix, t.Keys))
+	t.setBackendError(err)
 	if err != nil {
 		return err
 	}
 	t.store.Purge()
+	values := make(map[string]string, len(result))
 	for k, v := range result {
-		t.store.Set(filepath.Join("/", strings.TrimPrefix(k, t.prefix)), v)
+		key := filepath.Join("/", strings.TrimPrefix(k, t.prefix))
+		t.store.Set(key, v)
+		values[key] = v
 	}
+	t.setChangedKeys(values)
 	return nil
 }
 
@@ -164,15 +350,38 @@ func (t *TemplateResource) sync() error {
 		log.Warning("Noop mode enabled. " + t.Dest + " will not be modified")
 		return nil
 	}
+	// confd rollback must not hold t between the check and the rename.
+	defer t.lockHoldIfAny()()
+	if t.isHeld() {
+		log.Info(t.Dest + " is held by confd rollback and will not be modified")
+		t.outcome = OutcomeHeld
+		return nil
+	}
 	if !ok {
 		log.Info("Target config " + t.Dest + " out of sync")
+		if rejected, err := t.rejected(); err != nil {
+			log.Error(err.Error())
+		} else if rejected {
+			log.Warning(t.Dest + " was rolled back after being rendered from the same values and will not be modified until they change")
+			t.outcome = OutcomeRejected
+			return nil
+		}
 		if t.CheckCmd != "" {
 			if err := t.check(); err != nil {
+				t.outcome = OutcomeCheckFailed
+				checkFailuresTotal.WithLabelValues(t.name, t.backend).Inc()
 				return errors.New("Config check failed: " + err.Error())
 			}
 		}
+		previous, err := t.copyDest()
+		if err != nil {
+			return err
+		}
+		if err := t.backup(previous); err != nil {
+			log.Error(fmt.Sprintf("Cannot back up %s: %s", t.Dest, err.Error()))
+		}
 		log.Debug("Overwriting target config " + t.Dest)
-		err := os.Rename(staged, t.Dest)
+		err = os.Rename(staged, t.Dest)
 		if err != nil {
 			if strings.Contains(err.Error(), "device or resource busy") {
 				log.Debug("Rename failed - target is likely a mount. Trying to write instead")
@@ -193,26 +402,22 @@ func (t *TemplateResource) sync() error {
 				return err
 			}
 		}
-		if t.ReloadCmd != "" {
-			err := t.reloadAndCreateMarker()
-			if err != nil {
-				log.Error(err.Error())
-			}
-		}
-		log.Info("Target config " + t.Dest + " has been updated")
+		changesTotal.WithLabelValues(t.name, t.backend).Inc()
+		t.outcome = OutcomeUpdated
+		// The reload command runs once every resource of the pass has been
+		// written, see reloadGroup.
+		t.setPending(previous)
 	} else {
-		if t.ReloadCmd != "" {
-			reloadedOk, err := sameConfig(t.Dest, t.reloadCmdMarkerFilePath())
+		if t.reloads() {
+			reloadedOk, err := t.reloaded()
 			if err != nil {
 				log.Error(err.Error())
 			}
 
 			if !reloadedOk {
-				err := t.reloadAndCreateMarker()
-				if err != nil {
-					log.Error(err.Error())
-				}
+				t.setPending(nil)
 			} else {
+				t.delayed = nil
 				log.Debug("Reload command already ran for the dest file")
 			}
 		}
@@ -221,29 +426,41 @@ func (t *TemplateResource) sync() error {
 	return nil
 }
 
-func (t *TemplateResource) reloadAndCreateMarker() error {
-	t.reloadWithRetry()
-	log.Debug("Reload command executed successfully")
-	err := t.createReloadCmdMarkerFile()
-	if err != nil {
-		return err
+// reloadAndVerify runs the reload command and then verifies the service,
+// if set.
+// It returns an error if the reload command failed, or the verification
+// if it counts as a failed reload.
+func (t *TemplateResource) reloadAndVerify() error {
+	var err error
+	if t.reloads() {
+		err = t.reloadWithRetry()
 	}
-	log.Debug("Created Reload Marker file successfully")
-	return nil
+	return t.verifyReload(err)
 }
 
-func (t *TemplateResource) createReloadCmdMarkerFile() error {
-	contents, err := ioutil.ReadFile(t.Dest)
-	if err != nil {
-		return err
+// verifyReload verifies the service, if set, after the reload command of t
+// ended with err.
+// It returns an error if the reload command failed, or the verification
+// if it counts as a failed reload.
+func (t *TemplateResource) verifyReload(err error) error {
+	if t.reloads() {
+		if err != nil {
+			t.outcome = OutcomeReloadFailed
+			return fmt.Errorf("Reload command of %s failed: %s", t.Dest, err.Error())
+		}
+		log.Debug("Reload command executed successfully")
 	}
-	reloadMarkerFilePath := t.reloadCmdMarkerFilePath()
-	log.Debug("Reload Comamnd Marker " + reloadMarkerFilePath)
-	err = ioutil.WriteFile(reloadMarkerFilePath, contents, t.FileMode)
-	// make sure owner and group match the temp file, in case the file was created with WriteFile
-	os.Chown(reloadMarkerFilePath, t.Uid, t.Gid)
-	if err != nil {
-		return err
+	if t.verifies() {
+		if err := t.verify(); err != nil {
+			verifyFailuresTotal.WithLabelValues(t.name, t.backend).Inc()
+			if !t.VerifyFailsReload {
+				log.Warning(fmt.Sprintf("Verification of %s failed: %s", t.Dest, err.Error()))
+				return nil
+			}
+			t.outcome = OutcomeVerifyFailed
+			return fmt.Errorf("Verification of %s failed: %s", t.Dest, err.Error())
+		}
+		log.Debug("Verification succeeded")
 	}
 	return nil
 }
@@ -255,19 +472,17 @@ func (t *TemplateResource) createReloadCmdMarkerFile() error {
 // file.
 // It returns nil if the check command returns 0 and there are no other errors.
 func (t *TemplateResource) check() error {
-	var cmdBuffer bytes.Buffer
-	data := make(map[string]string)
-	data["src"] = t.StageFile.Name()
-	tmpl, err := template.New("checkcmd").Parse(t.CheckCmd)
-	if err != nil {
-		return err
+	vars := cmdContext{
+		src:     t.StageFile.Name(),
+		oldHash: fileHash(t.Dest),
+		newHash: fileHash(t.StageFile.Name()),
 	}
-	if err := tmpl.Execute(&cmdBuffer, data); err != nil {
+	cmd, err := t.renderCommand("checkcmd", t.CheckCmd, vars)
+	if err != nil {
 		return err
 	}
-	log.Debug("Running " + cmdBuffer.String())
-	c := exec.Command("/bin/sh", "-c", cmdBuffer.String())
-	output, err := c.CombinedOutput()
+	log.Debug("Running " + cmd)
+	output, err := t.shellCommand(cmd, vars).CombinedOutput()
 	if err != nil {
 		log.Error(fmt.Sprintf("%q", string(output)))
 		return err
@@ -279,44 +494,63 @@ func (t *TemplateResource) check() error {
 // reload executes the reload command.
 // It returns nil if the reload command returns 0.
 func (t *TemplateResource) reload() error {
-	log.Debug("Running " + t.ReloadCmd)
-	c := exec.Command("/bin/sh", "-c", t.ReloadCmd)
-	output, err := c.CombinedOutput()
-	if err != nil {
-		log.Error(fmt.Sprintf("%q", string(output)))
-		return err
-	}
-	log.Debug(fmt.Sprintf("%q", string(output)))
-	return nil
+	return reloadGroup{t}.reload()
 }
 
-// Keep trying to execute reload command till
-// it exits with one
-func (t *TemplateResource) reloadWithRetry() {
-	for i:= 0; i < 10; i++ {
-		if err := t.reload(); err == nil {
-			return;
-		}
-		time.Sleep(time.Second * 20)
-	}
+// reloadWithRetry runs the reload command, retrying it up to ReloadRetries
+// times ReloadBackoff seconds apart while it fails.
+// It returns the error of the last attempt if all of them failed.
+func (t *TemplateResource) reloadWithRetry() error {
+	return reloadGroup{t}.reloadWithRetry()
 }
 
-func (t *TemplateResource) reloadCmdMarkerName() string {
-	trimmedString := strings.TrimPrefix(t.Prefix + t.Src + t.Dest, "/")
-	replacedString := strings.Replace(trimmedString, ".", "_", -1)
-	return strings.Replace(replacedString, "/", "_", -1)
+// command returns a command running cmd with the shell. It runs in its own
+// process group so that a signal sent to confd's group, such as a Ctrl-C,
+// does not kill it halfway through while confd shuts down.
+func command(cmd string) *exec.Cmd {
+	c := exec.Command("/bin/sh", "-c", cmd)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return c
 }
 
-func (t *TemplateResource) reloadCmdMarkerFilePath() string {
-	return t.reloadCmdMarkerDir + "/" + t.reloadCmdMarkerName()
+// run runs c and returns its combined output. If timeout is positive and c
+// runs longer, the process group of c is killed.
+func run(c *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	var output bytes.Buffer
+	c.Stdout = &output
+	c.Stderr = &output
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		err := c.Wait()
+		return output.Bytes(), err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+	select {
+	case err := <-done:
+		return output.Bytes(), err
+	case <-time.After(timeout):
+		// c runs in its own process group, see command.
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		<-done
+		return output.Bytes(), fmt.Errorf("killed after %s", timeout)
+	}
 }
 
 // process is a convenience function that wraps calls to the three main tasks
 // required to keep local configuration files in sync. First we gather vars
 // from the store, then we stage a candidate configuration file, and finally sync
-// things up.
+// things up, in a pass of its own. The outcome is recorded in the status of t.
 // It returns an error if any.
 func (t *TemplateResource) process() error {
+	return processPass([]*TemplateResource{t}, 1)[0]
+}
+
+func (t *TemplateResource) processStages() error {
 	if err := t.setFileMode(); err != nil {
 		return err
 	}
@@ -332,6 +566,119 @@ func (t *TemplateResource) process() error {
 	return nil
 }
 
+// renderEmpty renders the template without any values from the store and
+// syncs the result to the dest.
+// It returns an error if any.
+func (t *TemplateResource) renderEmpty() error {
+	t.processMutex.Lock()
+	defer t.processMutex.Unlock()
+	if t.closed {
+		return nil
+	}
+	if err := t.setFileMode(); err != nil {
+		return err
+	}
+	t.store.Purge()
+	t.setChangedKeys(map[string]string{})
+	if err := t.createStageFile(); err != nil {
+		return err
+	}
+	t.pending = nil
+	if err := t.sync(); err != nil {
+		return err
+	}
+	if t.pending != nil {
+		reloadGroup{t}.reloadAndFinish()
+	}
+	return nil
+}
+
+// removeDest deletes the dest and runs the reload command if set.
+// It returns an error if any.
+func (t *TemplateResource) removeDest() error {
+	t.processMutex.Lock()
+	defer t.processMutex.Unlock()
+	if t.closed {
+		return nil
+	}
+	if t.noop {
+		log.Warning("Noop mode enabled. " + t.Dest + " will not be removed")
+		return nil
+	}
+	unlock := t.lockHoldIfAny()
+	if t.isHeld() {
+		unlock()
+		log.Info(t.Dest + " is held by confd rollback and will not be removed")
+		return nil
+	}
+	t.reloadCtx = cmdContext{src: t.Dest, oldHash: fileHash(t.Dest)}
+	err := os.Remove(t.Dest)
+	unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Info("Target config " + t.Dest + " has been removed")
+	if t.reloads() {
+		return t.reload()
+	}
+	return nil
+}
+
+// context returns the context of the backend calls made for t.
+func (t *TemplateResource) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// stopRetrying makes a reload command being retried, and a backend call in
+// progress, give up.
+func (t *TemplateResource) stopRetrying() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// close prevents t from being processed again and waits for the processing
+// in progress, if any, to finish.
+func (t *TemplateResource) close() {
+	t.stopRetrying()
+	t.processMutex.Lock()
+	defer t.processMutex.Unlock()
+	t.closed = true
+	if t.reloadTimer != nil {
+		t.reloadTimer.Stop()
+	}
+}
+
+// removeStageFiles removes the stage files of t left behind by processing
+// that was interrupted, unless stage files are kept.
+// It returns an error if any.
+func (t *TemplateResource) removeStageFiles() error {
+	if t.keepStageFile {
+		return nil
+	}
+	prefix := "." + filepath.Base(t.Dest)
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(t.Dest), prefix+"*"))
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, m := range matches {
+		// ioutil.TempFile appends a number to the prefix.
+		suffix := strings.TrimPrefix(filepath.Base(m), prefix)
+		if _, err := strconv.ParseUint(suffix, 10, 64); err != nil {
+			continue
+		}
+		log.Info("Removing stage file " + m)
+		if err := os.Remove(m); err != nil && !os.IsNotExist(err) {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
 // setFileMode sets the FileMode.
 func (t *TemplateResource) setFileMode() error {
 	if t.Mode == "" {
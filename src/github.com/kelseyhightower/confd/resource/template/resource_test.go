@@ -1,11 +1,14 @@
 package template
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/kelseyhightower/confd/backends/env"
 	"github.com/kelseyhightower/confd/log"
@@ -92,7 +95,7 @@ func TestProcessTemplateResources(t *testing.T) {
 		ConfigDir:   filepath.Join(tempConfDir, "conf.d"),
 		StoreClient: storeClient,
 		TemplateDir: filepath.Join(tempConfDir, "templates"),
-		ReloadCmdMarkerDir: "/var/lib/confd",
+		ReloadCmdMarkerDir: tempConfDir,
 	}
 	// Process the test template resource.
 	err = Process(c)
@@ -109,14 +112,17 @@ func TestProcessTemplateResources(t *testing.T) {
 		t.Errorf("Expected contents of dest == '%s', got %s", expected, string(results))
 	}
 
-	resourceCmdMarker, err := ioutil.ReadFile("/var/lib/confd/var_folders_g0_072gc5hn299brqp7l07k9hxsw00w9x_T_249323830_templates_foo_tmpl_var_folders_g0_072gc5hn299brqp7l07k9hxsw00w9x_T_252091677")
+	stateData, err := ioutil.ReadFile(filepath.Join(tempConfDir, "state", "foo.json"))
 	if err != nil {
-		t.Error(err.Error())
+		t.Fatal(err.Error())
 	}
-	if string(resourceCmdMarker) != expected {
-		t.Errorf("Expected contents of reload command marker == '%s', got %s", expected, string(resourceCmdMarker))
+	var state resourceState
+	if err := json.Unmarshal(stateData, &state); err != nil {
+		t.Fatal(err.Error())
+	}
+	if state.DestHash != hashOf([]byte(expected)) || state.ExitStatus != 0 || state.Error != "" || state.LastReload.IsZero() {
+		t.Errorf("Expected the state to record a successful reload of '%s', got %+v", expected, state)
 	}
-
 }
 
 func TestSameConfigTrue(t *testing.T) {
@@ -176,3 +182,210 @@ func TestSameConfigFalse(t *testing.T) {
 		t.Errorf("Expected sameConfig(src, dest) to be %v, got %v", false, status)
 	}
 }
+
+func TestNewTemplateResourceOnBucketDeleted(t *testing.T) {
+	log.SetLevel("warn")
+	tempConfDir, err := createTempDirs()
+	if err != nil {
+		t.Fatalf("Failed to create temp dirs: %s", err.Error())
+	}
+	defer os.RemoveAll(tempConfDir)
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c := Config{
+		ConfDir:     tempConfDir,
+		ConfigDir:   filepath.Join(tempConfDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(tempConfDir, "templates"),
+	}
+	tests := []struct {
+		policy string
+		want   string
+		valid  bool
+	}{
+		{"", BucketDeletedKeep, true},
+		{BucketDeletedRenderEmpty, BucketDeletedRenderEmpty, true},
+		{BucketDeletedRemoveDest, BucketDeletedRemoveDest, true},
+		{BucketDeletedFail, BucketDeletedFail, true},
+		{"explode", "", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(tempConfDir, "conf.d", "foo.toml")
+		resource := "[template]\nsrc = \"foo.tmpl\"\ndest = \"/tmp/foo\"\n"
+		if tt.policy != "" {
+			resource += "on_bucket_deleted = \"" + tt.policy + "\"\n"
+		}
+		if err := ioutil.WriteFile(path, []byte(resource), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		tr, err := NewTemplateResource(path, c)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("Expected on_bucket_deleted %q to be rejected", tt.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("on_bucket_deleted %q: %s", tt.policy, err.Error())
+			continue
+		}
+		if tr.OnBucketDeleted != tt.want {
+			t.Errorf("on_bucket_deleted %q: got %q, want %q", tt.policy, tr.OnBucketDeleted, tt.want)
+		}
+	}
+}
+
+func TestRemoveStageFiles(t *testing.T) {
+	log.SetLevel("warn")
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]bool{
+		"foo.conf":        true,
+		".foo.conf123456": false,
+		".foo.conf.bak":   true,
+		".foo.confd":      true,
+		".bar.conf98765":  true,
+		".foo.conf":       true,
+	}
+	for name := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	tr := &TemplateResource{Dest: filepath.Join(dir, "foo.conf")}
+	if err := tr.removeStageFiles(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, kept := range files {
+		if isFileExist(filepath.Join(dir, name)) != kept {
+			t.Errorf("Expected %s to be kept: %t", name, kept)
+		}
+	}
+}
+
+func TestNewTemplateResourceReloadPolicy(t *testing.T) {
+	log.SetLevel("warn")
+	tempConfDir, err := createTempDirs()
+	if err != nil {
+		t.Fatalf("Failed to create temp dirs: %s", err.Error())
+	}
+	defer os.RemoveAll(tempConfDir)
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c := Config{
+		ConfDir:     tempConfDir,
+		ConfigDir:   filepath.Join(tempConfDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(tempConfDir, "templates"),
+	}
+	tests := []struct {
+		policy                    string
+		retries, backoff, timeout int
+		valid                     bool
+	}{
+		{"", defaultReloadRetries, defaultReloadBackoff, defaultReloadTimeout, true},
+		{"reload_retries = 0\nreload_backoff = 0\nreload_timeout = 0\n", 0, 0, 0, true},
+		{"reload_retries = 3\nreload_backoff = 5\nreload_timeout = 30\n", 3, 5, 30, true},
+		{"reload_timeout = -1\n", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(tempConfDir, "conf.d", "foo.toml")
+		resource := "[template]\nsrc = \"foo.tmpl\"\ndest = \"/tmp/foo\"\n" + tt.policy
+		if err := ioutil.WriteFile(path, []byte(resource), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		tr, err := NewTemplateResource(path, c)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected", tt.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.policy, err.Error())
+			continue
+		}
+		if tr.ReloadRetries != tt.retries || tr.ReloadBackoff != tt.backoff || tr.ReloadTimeout != tt.timeout {
+			t.Errorf("%q: got %d, %d, %d, want %d, %d, %d", tt.policy,
+				tr.ReloadRetries, tr.ReloadBackoff, tr.ReloadTimeout, tt.retries, tt.backoff, tt.timeout)
+		}
+	}
+}
+
+func TestReloadRetries(t *testing.T) {
+	log.SetLevel("error")
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "foo.conf")
+	if err := ioutil.WriteFile(dest, []byte("foo = bar"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	attempts := filepath.Join(dir, "attempts")
+	tr := &TemplateResource{
+		Dest:               dest,
+		FileMode:           0644,
+		ReloadCmd:          "echo >> " + attempts + "; false",
+		ReloadRetries:      2,
+		reloadCmdMarkerDir: dir,
+	}
+	tr.pending = &pendingReload{}
+	tr.processMutex.Lock()
+	reloadGroup{tr}.reloadAndFinish()
+	tr.processMutex.Unlock()
+	if tr.status.ReloadResult == "ok" {
+		t.Fatal("Expected the reload to fail")
+	}
+	if tr.outcome != OutcomeReloadFailed {
+		t.Errorf("Expected outcome %s, got %s", OutcomeReloadFailed, tr.outcome)
+	}
+	data, err := ioutil.ReadFile(attempts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Errorf("Expected 3 attempts, got %d", n)
+	}
+	// A failed reload must be run again.
+	if ok, err := tr.reloaded(); ok || err != nil {
+		t.Errorf("Expected the reload to be recorded as failed, got %v", err)
+	}
+
+	tr.ReloadCmd = "true"
+	tr.pending = &pendingReload{}
+	tr.processMutex.Lock()
+	reloadGroup{tr}.reloadAndFinish()
+	tr.processMutex.Unlock()
+	if tr.status.ReloadResult != "ok" {
+		t.Fatal(tr.status.ReloadResult)
+	}
+	if ok, err := tr.reloaded(); !ok || err != nil {
+		t.Errorf("Expected the reload to be recorded as successful, got %v", err)
+	}
+}
+
+func TestReloadTimeout(t *testing.T) {
+	log.SetLevel("error")
+	// The background sleep holds the output of the command open, so the
+	// reload only returns if the whole process group is killed.
+	tr := &TemplateResource{ReloadCmd: "sleep 30 & sleep 30", ReloadTimeout: 1}
+	start := time.Now()
+	if err := tr.reload(); err == nil {
+		t.Fatal("Expected the reload to time out")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Expected the reload to be killed after 1s, took %s", d)
+	}
+	if tr.status.ReloadExitCode != -1 {
+		t.Errorf("Expected exit code -1, got %d", tr.status.ReloadExitCode)
+	}
+}
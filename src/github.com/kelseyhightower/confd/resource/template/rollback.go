@@ -0,0 +1,125 @@
+package template
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// previousDest is a copy of a dest file taken before it is overwritten, so
+// that it can be restored if the new one is rejected.
+type previousDest struct {
+	exists   bool
+	contents []byte
+	mode     os.FileMode
+	uid      int
+	gid      int
+}
+
+// copyDest returns a copy of the dest of t.
+// It returns an error if any.
+func (t *TemplateResource) copyDest() (*previousDest, error) {
+	fi, err := os.Stat(t.Dest)
+	if os.IsNotExist(err) {
+		return &previousDest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadFile(t.Dest)
+	if err != nil {
+		return nil, err
+	}
+	p := &previousDest{exists: true, contents: contents, mode: fi.Mode(), uid: -1, gid: -1}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		p.uid, p.gid = int(stat.Uid), int(stat.Gid)
+	}
+	return p, nil
+}
+
+// restoreDest puts previous back in place of the dest of t, removing the
+// dest if there was none before.
+// It returns an error if any.
+func (t *TemplateResource) restoreDest(previous *previousDest) error {
+	if !previous.exists {
+		if err := os.Remove(t.Dest); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	// Write next to the dest so that the rename is atomic. Should confd die
+	// halfway through, the file is cleaned up like a stage file.
+	temp, err := ioutil.TempFile(filepath.Dir(t.Dest), "."+filepath.Base(t.Dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(previous.contents)
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(temp.Name(), previous.mode)
+	os.Chown(temp.Name(), previous.uid, previous.gid)
+	return os.Rename(temp.Name(), t.Dest)
+}
+
+// rollback restores the previous dest of each member of g after its new
+// dest was rejected with the matching cause, and runs the reload command
+// again, once, so that the service picks the previous configs back up. The
+// rollback is recorded in the status of each member.
+// It returns the error of the rollback of each member, in the order of g.
+func (g reloadGroup) rollback(previous []*previousDest, causes []error) []error {
+	errs := make([]error, len(g))
+	var restored reloadGroup
+	var indexes []int
+	for i, t := range g {
+		log.Warning("Rolling back " + t.Dest + " to its previous version")
+		errs[i] = t.restoreDest(previous[i])
+		t.reloadCtx = cmdContext{src: t.Dest, oldHash: t.reloadCtx.newHash}
+		if previous[i].exists {
+			t.reloadCtx.newHash = hashOf(previous[i].contents)
+		}
+		if errs[i] == nil && t.reloads() {
+			restored = append(restored, t)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(restored) > 0 {
+		err := restored.reloadWithRetry()
+		for _, i := range indexes {
+			if previous[i].exists {
+				if serr := g[i].saveState(err, ""); serr != nil {
+					log.Error("Cannot save the state of " + g[i].name + ": " + serr.Error())
+				}
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("reload command failed: %s", err.Error())
+			}
+		}
+	}
+	for i, t := range g {
+		// A failed reload command may be transient, so its values are
+		// tried again on the next pass, while a failed verification means
+		// the service rejected them.
+		if t.outcome == OutcomeVerifyFailed {
+			if err := t.recordRejected(t.keyFingerprint()); err != nil {
+				log.Error("Cannot save the state of " + t.name + ": " + err.Error())
+			}
+		}
+		t.recordRollback(causes[i], errs[i])
+		rollbacksTotal.WithLabelValues(t.name, t.backend).Inc()
+		if errs[i] != nil {
+			log.Error("Cannot roll back " + t.Dest + ": " + errs[i].Error())
+			continue
+		}
+		log.Warning("Rolled back " + t.Dest + " to its previous version")
+	}
+	return errs
+}
@@ -0,0 +1,204 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kelseyhightower/confd/backends/env"
+	"github.com/kelseyhightower/confd/log"
+)
+
+// newRollbackResource returns a template resource rendering
+// "foo = <ROLLBACK_FOO>" to dest with the commands in cmds. It is named
+// after dest.
+func newRollbackResource(t *testing.T, confDir, dest, cmds string) *TemplateResource {
+	err := ioutil.WriteFile(filepath.Join(confDir, "templates", "foo.tmpl"), []byte(`foo = {{getv "/rollback/foo"}}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	name := strings.TrimSuffix(filepath.Base(dest), filepath.Ext(dest))
+	path := filepath.Join(confDir, "conf.d", name+".toml")
+	resource := "[template]\nsrc = \"foo.tmpl\"\ndest = \"" + dest + "\"\nmode = \"0644\"\nkeys = [\"/rollback/foo\"]\n" +
+		"reload_retries = 0\n" + cmds
+	if err := ioutil.WriteFile(path, []byte(resource), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	tr, err := NewTemplateResource(path, rollbackConfig(t, confDir))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return tr
+}
+
+// rollbackConfig returns the config of the resources made by
+// newRollbackResource.
+func rollbackConfig(t *testing.T, confDir string) Config {
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return Config{
+		ConfDir:            confDir,
+		ConfigDir:          filepath.Join(confDir, "conf.d"),
+		StoreClient:        storeClient,
+		TemplateDir:        filepath.Join(confDir, "templates"),
+		ReloadCmdMarkerDir: confDir,
+	}
+}
+
+func TestRollbackOnReloadFailure(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	dest := filepath.Join(confDir, "foo.conf")
+	if err := ioutil.WriteFile(dest, []byte("foo = old"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The service only accepts the old config.
+	tr := newRollbackResource(t, confDir, dest, "reload_cmd = \"grep -q old "+dest+"\"\n")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(data) != "foo = old" {
+		t.Errorf("Expected the previous dest to be restored, got %q", string(data))
+	}
+	if fi, err := os.Stat(dest); err != nil || fi.Mode() != 0600 {
+		t.Errorf("Expected the previous mode to be restored, got %v", fi.Mode())
+	}
+	s := tr.Status()
+	if s.LastOutcome != OutcomeReloadFailed {
+		t.Errorf("Expected outcome %s, got %s", OutcomeReloadFailed, s.LastOutcome)
+	}
+	if s.LastRollback.IsZero() || s.RollbackCause == "" || s.RollbackResult != "ok" {
+		t.Errorf("Expected a successful rollback in the status, got %+v", s)
+	}
+	// The failed reload does not count as a successful render.
+	if s.LastError == "" || !s.LastRender.IsZero() {
+		t.Errorf("Expected the failed reload to be recorded as the last error, got %+v", s)
+	}
+	// The reload ran for the restored dest.
+	if ok, err := tr.reloaded(); !ok || err != nil {
+		t.Errorf("Expected the reload to be recorded for the restored dest, got %v", err)
+	}
+
+	// A failed reload command may be transient, so the values are applied
+	// again.
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := tr.Status(); s.LastOutcome != OutcomeReloadFailed {
+		t.Errorf("Expected outcome %s, got %s", OutcomeReloadFailed, s.LastOutcome)
+	}
+}
+
+func TestRollbackOnVerifyFailure(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	dest := filepath.Join(confDir, "foo.conf")
+
+	tr := newRollbackResource(t, confDir, dest, "reload_cmd = \"true\"\nverify_cmd = \"exit 1\"\nverify_fails_reload = true\n")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	// There was no dest before, so the rejected one is removed.
+	if isFileExist(dest) {
+		t.Error("Expected the rejected dest to be removed")
+	}
+	if s := tr.Status(); s.LastOutcome != OutcomeVerifyFailed || s.RollbackResult != "ok" {
+		t.Errorf("Expected a rollback after the verify command failed, got %+v", s)
+	}
+}
+
+func TestRollbackRejectsSameValues(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	dest := filepath.Join(confDir, "foo.conf")
+	runs := filepath.Join(confDir, "runs")
+	if err := ioutil.WriteFile(dest, []byte("foo = old"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The service only works with an old config.
+	tr := newRollbackResource(t, confDir, dest, "reload_cmd = \"echo >> "+runs+"\"\nverify_cmd = \"grep -q old "+dest+"\"\nverify_fails_reload = true\n")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := countRuns(t, runs); n != 2 {
+		t.Fatalf("Expected the reload command to run for the new and the restored dest, ran %d times", n)
+	}
+
+	// The same values are not applied again.
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := tr.Status(); s.LastOutcome != OutcomeRejected {
+		t.Errorf("Expected outcome %s, got %s", OutcomeRejected, s.LastOutcome)
+	}
+	if n := countRuns(t, runs); n != 2 {
+		t.Errorf("Expected the rejected values not to be reloaded again, ran %d times", n)
+	}
+	if data, err := ioutil.ReadFile(dest); err != nil || string(data) != "foo = old" {
+		t.Errorf("Expected the restored dest to be kept, got %q", string(data))
+	}
+
+	// Unless the resource is triggered.
+	s := &resourceSet{concurrency: 1, resources: []*TemplateResource{tr}}
+	results, err := s.Trigger("foo")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 1 || results[0].Outcome != OutcomeVerifyFailed {
+		t.Errorf("Expected the triggered values to be applied again, got %+v", results)
+	}
+	if n := countRuns(t, runs); n != 4 {
+		t.Errorf("Expected the triggered values to be reloaded and rolled back, ran %d times", n)
+	}
+
+	// Or released.
+	if err := Release(rollbackConfig(t, confDir), "foo"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if rejected, err := tr.rejected(); rejected || err != nil {
+		t.Errorf("Expected the released values not to be rejected, got %v", err)
+	}
+	if err := Release(rollbackConfig(t, confDir), "foo"); err == nil {
+		t.Error("Expected releasing a resource neither held nor rolled back to fail")
+	}
+
+	// New values are applied.
+	os.Setenv("ROLLBACK_FOO", "older")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := tr.Status(); s.LastOutcome != OutcomeUpdated {
+		t.Errorf("Expected outcome %s, got %s", OutcomeUpdated, s.LastOutcome)
+	}
+	if data, err := ioutil.ReadFile(dest); err != nil || string(data) != "foo = older" {
+		t.Errorf("Expected the new values to be applied, got %q", string(data))
+	}
+}
@@ -0,0 +1,128 @@
+package template
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultPath is the PATH of the commands of a resource clearing the
+// environment, unless its env sets one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// setCredential resolves the user and group the commands of t run as.
+// It returns an error if any.
+func (t *TemplateResource) setCredential() error {
+	if t.RunAsUser == "" && t.RunAsGroup == "" {
+		return nil
+	}
+	cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if t.RunAsUser != "" {
+		uid, gid, groups, err := lookupUser(t.RunAsUser)
+		if err != nil {
+			return err
+		}
+		if gid < 0 && t.RunAsGroup == "" {
+			return fmt.Errorf("run_as_group is required with the unknown user id %s", t.RunAsUser)
+		}
+		cred.Uid, cred.Groups = uint32(uid), groups
+		if gid >= 0 {
+			cred.Gid = uint32(gid)
+		}
+	}
+	if t.RunAsGroup != "" {
+		gid, err := lookupGroup(t.RunAsGroup)
+		if err != nil {
+			return err
+		}
+		cred.Gid = uint32(gid)
+	}
+	t.credential = cred
+	return nil
+}
+
+// lookupUser returns the uid, primary gid and supplementary groups of the
+// user named or numbered name. A number missing from the user database is
+// used as is, with a gid of -1.
+// It returns an error if any.
+func lookupUser(name string) (int, int, []uint32, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		if uid, aerr := strconv.Atoi(name); aerr == nil && uid >= 0 {
+			return uid, -1, nil, nil
+		}
+		return 0, 0, nil, fmt.Errorf("unknown run_as_user %q", name)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var groups []uint32
+	// The supplementary groups may not be available, in which case the
+	// command has none.
+	ids, _ := u.GroupIds()
+	for _, id := range ids {
+		if g, err := strconv.Atoi(id); err == nil {
+			groups = append(groups, uint32(g))
+		}
+	}
+	return uid, gid, groups, nil
+}
+
+// lookupGroup returns the gid of the group named or numbered name. A number
+// missing from the group database is used as is.
+// It returns an error if any.
+func lookupGroup(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		g, err = user.LookupGroupId(name)
+	}
+	if err != nil {
+		if gid, aerr := strconv.Atoi(name); aerr == nil && gid >= 0 {
+			return gid, nil
+		}
+		return 0, fmt.Errorf("unknown run_as_group %q", name)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// shellCommand returns a command running cmd with the shell for t, as its
+// user, in its working dir and with the environment of c.
+func (t *TemplateResource) shellCommand(cmd string, c cmdContext) *exec.Cmd {
+	e := command(cmd)
+	e.Dir = t.WorkingDir
+	e.Env = t.commandEnv(c)
+	e.SysProcAttr.Credential = t.credential
+	return e
+}
+
+// commandSettings describes how the commands of t run, so that resources
+// only share a reload command run with the same settings.
+func (t *TemplateResource) commandSettings() string {
+	s := []string{t.RunAsUser, t.RunAsGroup, t.WorkingDir, strconv.FormatBool(t.ClearEnv)}
+	for _, k := range sortedKeys(t.Env) {
+		s = append(s, k+"="+t.Env[k])
+	}
+	return strings.Join(s, "\x00")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,100 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommandEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	// The temp dir may be a symlink.
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Setenv("CONFD_TEST_INHERITED", "yes")
+	defer os.Unsetenv("CONFD_TEST_INHERITED")
+	os.Setenv("CONFD_TEST_OVERRIDDEN", "confd")
+	defer os.Unsetenv("CONFD_TEST_OVERRIDDEN")
+
+	tr := &TemplateResource{
+		Dest:       filepath.Join(dir, "foo.conf"),
+		WorkingDir: dir,
+		Env:        map[string]string{"CONFD_TEST_OVERRIDDEN": "resource"},
+	}
+	out, err := tr.shellCommand("pwd; env", cmdContext{}).Output()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, want := range []string{dir + "\n", "CONFD_TEST_INHERITED=yes\n", "CONFD_TEST_OVERRIDDEN=resource\n", "CONFD_DEST=" + tr.Dest + "\n"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("Expected the output to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "CONFD_TEST_OVERRIDDEN=confd") {
+		t.Error("Expected env to override the environment of confd")
+	}
+
+	tr.ClearEnv = true
+	out, err = tr.shellCommand("env", cmdContext{}).Output()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Contains(string(out), "CONFD_TEST_INHERITED") {
+		t.Errorf("Expected the environment to be cleared, got:\n%s", out)
+	}
+	for _, want := range []string{"PATH=" + defaultPath + "\n", "CONFD_TEST_OVERRIDDEN=resource\n"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("Expected the output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestRunAs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Running commands as another user requires root")
+	}
+	tests := []struct {
+		user, group string
+		want        string
+		err         string
+	}{
+		{"nobody", "", "65534 65534", ""},
+		{"65534", "", "65534 65534", ""},
+		{"nobody", "12345", "65534 12345", ""},
+		{"12345", "12345", "12345 12345", ""},
+		{"", "12345", "0 12345", ""},
+		{"12345", "", "", "run_as_group is required"},
+		{"confd-no-such-user", "", "", "unknown run_as_user"},
+		{"nobody", "confd-no-such-group", "", "unknown run_as_group"},
+	}
+	for _, tt := range tests {
+		tr := &TemplateResource{RunAsUser: tt.user, RunAsGroup: tt.group}
+		err := tr.setCredential()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s:%s: expected an error containing %q, got %v", tt.user, tt.group, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s:%s: %s", tt.user, tt.group, err.Error())
+			continue
+		}
+		out, err := tr.shellCommand("echo $(id -u) $(id -g)", cmdContext{}).Output()
+		if err != nil {
+			t.Errorf("%s:%s: %s", tt.user, tt.group, err.Error())
+			continue
+		}
+		if got := strings.TrimSpace(string(out)); got != tt.want {
+			t.Errorf("%s:%s: expected ids %q, got %q", tt.user, tt.group, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// reloadSignals maps the names accepted by reload_signal to signals.
+var reloadSignals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// reloads reports whether t runs a reload command or sends a reload signal.
+func (t *TemplateResource) reloads() bool {
+	return t.ReloadCmd != "" || t.ReloadSignal != ""
+}
+
+// parseSignal returns the signal named name, with or without its SIG
+// prefix.
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := reloadSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown reload_signal %q", name)
+	}
+	return sig, nil
+}
+
+// checkReloadSignal checks that the reload signal of t can be sent.
+// It returns an error if any.
+func (t *TemplateResource) checkReloadSignal() error {
+	if _, err := parseSignal(t.ReloadSignal); err != nil {
+		return err
+	}
+	if t.ReloadCmd != "" {
+		return errors.New("reload_cmd and reload_signal cannot be used together")
+	}
+	if (t.Pidfile == "") == (t.ProcessName == "") {
+		return errors.New("reload_signal requires either pidfile or process_name")
+	}
+	return nil
+}
+
+// signal sends the reload signal of t to its processes.
+// It returns an error if no process is running or any could not be
+// signaled.
+func (t *TemplateResource) signal() error {
+	sig, err := parseSignal(t.ReloadSignal)
+	if err != nil {
+		return err
+	}
+	var pids []int
+	if t.Pidfile != "" {
+		pid, err := readPidfile(t.Pidfile)
+		if err != nil {
+			return err
+		}
+		pids = []int{pid}
+	} else {
+		if pids, err = findProcesses(t.ProcessName); err != nil {
+			return err
+		}
+	}
+	for _, pid := range pids {
+		log.Debug(fmt.Sprintf("Sending %s to process %d", sig, pid))
+		if err := syscall.Kill(pid, sig); err != nil {
+			return fmt.Errorf("cannot send %s to process %d: %s", sig, pid, err.Error())
+		}
+	}
+	return nil
+}
+
+// readPidfile returns the pid held by the pidfile at path, once it checked
+// that the process is running.
+// It returns an error if the pidfile is missing, invalid or stale.
+func readPidfile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read pidfile: %s", err.Error())
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("pidfile %s does not hold a pid", path)
+	}
+	// Signal 0 only checks that the process exists. EPERM means it exists
+	// but belongs to another user, which the signal itself reports.
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return 0, fmt.Errorf("pidfile %s is stale: process %d is not running", path, pid)
+	}
+	return pid, nil
+}
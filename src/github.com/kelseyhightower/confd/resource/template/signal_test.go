@@ -0,0 +1,113 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// startTrap starts shell, or /bin/sh if empty, running a script that
+// appends a line to the returned file on every SIGHUP and writes its pid to
+// the returned pidfile. The script also starts a subshell, which has the
+// same name. The returned function kills both.
+func startTrap(t *testing.T, dir, shell string) (func(), string, string) {
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	hups := filepath.Join(dir, "hups")
+	pidfile := filepath.Join(dir, "pid")
+	script := "trap 'echo >> " + hups + "' HUP; echo $$ > " + pidfile + ".tmp; mv " + pidfile + ".tmp " + pidfile +
+		"; (while :; do sleep 0.1; done) & while :; do sleep 0.1; done"
+	c := exec.Command(shell, "-c", script)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := c.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 100 && !isFileExist(pidfile); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return func() {
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		c.Wait()
+	}, hups, pidfile
+}
+
+// waitForRuns waits until path holds n lines.
+func waitForRuns(t *testing.T, path string, n int) {
+	for i := 0; i < 100; i++ {
+		if countRuns(t, path) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d lines in %s, got %d", n, path, countRuns(t, path))
+}
+
+func TestReloadSignal(t *testing.T) {
+	log.SetLevel("error")
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	stop, hups, pidfile := startTrap(t, dir, "")
+	defer stop()
+
+	tr := &TemplateResource{ReloadSignal: "HUP", Pidfile: pidfile}
+	if err := tr.reload(); err != nil {
+		t.Fatal(err.Error())
+	}
+	waitForRuns(t, hups, 1)
+	if s := tr.Status(); s.ReloadResult != "ok" {
+		t.Errorf("Expected a successful reload, got %q", s.ReloadResult)
+	}
+
+	// Once the process exits, its pidfile is stale.
+	stop()
+	err = tr.reload()
+	if err == nil || !strings.Contains(err.Error(), "is stale") {
+		t.Errorf("Expected a stale pidfile error, got %v", err)
+	}
+	if s := tr.Status(); s.ReloadResult != err.Error() {
+		t.Errorf("Expected reload result %q, got %q", err.Error(), s.ReloadResult)
+	}
+
+	ioutil.WriteFile(pidfile, []byte("nginx\n"), 0644)
+	if err := tr.reload(); err == nil || !strings.Contains(err.Error(), "does not hold a pid") {
+		t.Errorf("Expected an invalid pidfile error, got %v", err)
+	}
+	os.Remove(pidfile)
+	if err := tr.reload(); err == nil || !strings.Contains(err.Error(), "cannot read pidfile") {
+		t.Errorf("Expected a missing pidfile error, got %v", err)
+	}
+}
+
+func TestCheckReloadSignal(t *testing.T) {
+	tests := []struct {
+		tr  *TemplateResource
+		err string
+	}{
+		{&TemplateResource{ReloadSignal: "HUP", Pidfile: "/run/nginx.pid"}, ""},
+		{&TemplateResource{ReloadSignal: "sigusr1", ProcessName: "nginx"}, ""},
+		{&TemplateResource{ReloadSignal: "KILL", ProcessName: "nginx"}, "unknown reload_signal"},
+		{&TemplateResource{ReloadSignal: "HUP"}, "either pidfile or process_name"},
+		{&TemplateResource{ReloadSignal: "HUP", Pidfile: "/run/nginx.pid", ProcessName: "nginx"}, "either pidfile or process_name"},
+		{&TemplateResource{ReloadSignal: "HUP", ProcessName: "nginx", ReloadCmd: "nginx -s reload"}, "cannot be used together"},
+	}
+	for _, tt := range tests {
+		err := tt.tr.checkReloadSignal()
+		if tt.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error %s", tt.tr, err.Error())
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%+v: expected an error containing %q, got %v", tt.tr, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package template
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// resourceState is what confd records of a template resource across runs,
+// as JSON in <reload_cmd_marker_dir>/state/<name>.json.
+type resourceState struct {
+	// DestHash, Mode, Uid and Gid describe the dest the reload command
+	// last ran for.
+	DestHash string      `json:"dest_hash"`
+	Mode     os.FileMode `json:"mode"`
+	Uid      uint32      `json:"uid"`
+	Gid      uint32      `json:"gid"`
+	// LastReload is when the reload command ran, and ExitStatus how it
+	// exited. Error is why the reload was rejected, or empty.
+	LastReload time.Time `json:"last_reload"`
+	ExitStatus int       `json:"exit_status"`
+	Error      string    `json:"error,omitempty"`
+	// KeyFingerprint is the md5 of the values the dest was rendered from,
+	// or empty if the dest was restored rather than rendered.
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+	// RejectedFingerprint is the KeyFingerprint of the values whose dest
+	// was last rolled back after failing verification. They are not
+	// applied again until they change or the resource is triggered or
+	// released.
+	RejectedFingerprint string `json:"rejected_fingerprint,omitempty"`
+}
+
+// statePath returns the path of the state of t.
+func (t *TemplateResource) statePath() string {
+	return filepath.Join(t.reloadCmdMarkerDir, "state", t.name+".json")
+}
+
+// loadState returns the state of t, or nil if there is none. A reload
+// command marker left by an older confd is migrated first.
+// It returns an error if any.
+func (t *TemplateResource) loadState() (*resourceState, error) {
+	data, err := ioutil.ReadFile(t.statePath())
+	if os.IsNotExist(err) {
+		return t.migrateMarker()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s resourceState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("Cannot read the state of %s - %s", t.name, err.Error())
+	}
+	return &s, nil
+}
+
+// writeState replaces the state of t with s.
+// It returns an error if any.
+func (t *TemplateResource) writeState(s *resourceState) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := t.statePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write next to the state so that the rename is atomic.
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(append(data, '\n'))
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(temp.Name(), 0644)
+	return os.Rename(temp.Name(), path)
+}
+
+// saveState records that the reload command of t ran for its current dest,
+// which was rendered from the values with the given fingerprint, and that
+// the reload was rejected with err, if not nil.
+// It returns an error if any.
+func (t *TemplateResource) saveState(err error, fingerprint string) error {
+	fi, ferr := fileStat(t.Dest)
+	if ferr != nil {
+		return ferr
+	}
+	t.statusMutex.Lock()
+	lastReload, exitStatus := t.status.LastReload, t.status.ReloadExitCode
+	t.statusMutex.Unlock()
+	return t.writeState(&resourceState{
+		DestHash:       fi.Md5,
+		Mode:           fi.Mode,
+		Uid:            fi.Uid,
+		Gid:            fi.Gid,
+		LastReload:     lastReload,
+		ExitStatus:     exitStatus,
+		Error:          errorString(err),
+		KeyFingerprint: fingerprint,
+	})
+}
+
+// reloaded reports whether the reload command of t succeeded for its
+// current dest.
+// It returns an error if any.
+func (t *TemplateResource) reloaded() (bool, error) {
+	s, err := t.loadState()
+	if err != nil || s == nil {
+		return false, err
+	}
+	fi, err := fileStat(t.Dest)
+	if err != nil {
+		return false, err
+	}
+	return s.Error == "" && s.DestHash == fi.Md5 && s.Mode == fi.Mode && s.Uid == fi.Uid && s.Gid == fi.Gid, nil
+}
+
+// recordRejected records that the dest rendered from the values with the
+// given fingerprint was rolled back after failing verification.
+// It returns an error if any.
+func (t *TemplateResource) recordRejected(fingerprint string) error {
+	s, err := t.loadState()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		s = &resourceState{}
+	}
+	s.RejectedFingerprint = fingerprint
+	return t.writeState(s)
+}
+
+// rejected reports whether the dest rendered from the current values of t
+// was rolled back.
+// It returns an error if any.
+func (t *TemplateResource) rejected() (bool, error) {
+	s, err := t.loadState()
+	if err != nil || s == nil {
+		return false, err
+	}
+	return s.RejectedFingerprint != "" && s.RejectedFingerprint == t.keyFingerprint(), nil
+}
+
+// clearRejected lets the values rolled back for t be applied again.
+// It returns whether any were rolled back and an error if any.
+func (t *TemplateResource) clearRejected() (bool, error) {
+	s, err := t.loadState()
+	if err != nil || s == nil || s.RejectedFingerprint == "" {
+		return false, err
+	}
+	s.RejectedFingerprint = ""
+	return true, t.writeState(s)
+}
+
+// retryRejected lets the values rolled back for t be applied again by the
+// next pass, as asked for by triggering t.
+func (t *TemplateResource) retryRejected() {
+	t.processMutex.Lock()
+	defer t.processMutex.Unlock()
+	if cleared, err := t.clearRejected(); err != nil {
+		log.Error("Cannot save the state of " + t.name + ": " + err.Error())
+	} else if cleared {
+		log.Info("Applying the values rolled back for " + t.Dest + " again")
+	}
+}
+
+// keyFingerprint returns the md5 of the values of the latest render of t.
+func (t *TemplateResource) keyFingerprint() string {
+	h := md5.New()
+	for _, k := range sortedKeys(t.values) {
+		fmt.Fprintf(h, "%q=%q\n", k, t.values[k])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// migrateMarker turns the reload command marker of t, a copy of the dest
+// kept by older versions of confd, into its state and removes it.
+// It returns nil if there is no marker.
+func (t *TemplateResource) migrateMarker() (*resourceState, error) {
+	marker := t.legacyMarkerPath()
+	info, err := os.Stat(marker)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fileStat(marker)
+	if err != nil {
+		return nil, err
+	}
+	s := &resourceState{
+		DestHash:   fi.Md5,
+		Mode:       fi.Mode,
+		Uid:        fi.Uid,
+		Gid:        fi.Gid,
+		LastReload: info.ModTime(),
+	}
+	if err := t.writeState(s); err != nil {
+		return nil, err
+	}
+	log.Info("Migrated reload command marker " + marker + " to " + t.statePath())
+	if err := os.Remove(marker); err != nil {
+		log.Error("Cannot remove reload command marker " + marker + ": " + err.Error())
+	}
+	return s, nil
+}
+
+// legacyMarkerPath returns the path of the reload command marker of t kept
+// by older versions of confd.
+func (t *TemplateResource) legacyMarkerPath() string {
+	trimmedString := strings.TrimPrefix(t.Prefix+t.Src+t.Dest, "/")
+	replacedString := strings.Replace(trimmedString, ".", "_", -1)
+	return t.reloadCmdMarkerDir + "/" + strings.Replace(replacedString, "/", "_", -1)
+}
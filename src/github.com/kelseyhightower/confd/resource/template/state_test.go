@@ -0,0 +1,102 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+func TestMigrateMarker(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	runs := filepath.Join(confDir, "runs")
+	dest := filepath.Join(confDir, "foo.conf")
+	tr := newRollbackResource(t, confDir, dest, "reload_cmd = \"echo >> "+runs+"\"\n")
+
+	// An older confd rendered the dest and kept a copy of it as the marker
+	// of its reload.
+	if err := ioutil.WriteFile(dest, []byte("foo = new"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	marker := tr.legacyMarkerPath()
+	if err := ioutil.WriteFile(marker, []byte("foo = new"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := countRuns(t, runs); n != 0 {
+		t.Errorf("Expected the migrated reload not to run again, ran %d times", n)
+	}
+	if isFileExist(marker) {
+		t.Error("Expected the marker to be removed")
+	}
+	s, err := tr.loadState()
+	if err != nil || s == nil {
+		t.Fatalf("Expected a migrated state, got %v", err)
+	}
+	if s.DestHash != hashOf([]byte("foo = new")) || s.Mode != 0644 || s.LastReload.IsZero() {
+		t.Errorf("Expected the state to describe the marker, got %+v", s)
+	}
+
+	// The state follows the dest from then on.
+	os.Setenv("ROLLBACK_FOO", "newer")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := countRuns(t, runs); n != 1 {
+		t.Errorf("Expected the reload to run once, ran %d times", n)
+	}
+	if s, err = tr.loadState(); err != nil || s.DestHash != hashOf([]byte("foo = newer")) || s.KeyFingerprint != tr.keyFingerprint() {
+		t.Errorf("Expected the state to describe the new dest, got %+v, %v", s, err)
+	}
+}
+
+func TestReloadedAfterFailure(t *testing.T) {
+	log.SetLevel("error")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	dest := filepath.Join(confDir, "foo.conf")
+	flag := filepath.Join(confDir, "fail")
+	if err := ioutil.WriteFile(flag, nil, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	// The reload fails while the flag exists. With no previous dest, the
+	// rollback removes the dest.
+	tr := newRollbackResource(t, confDir, dest, "reload_cmd = \"test ! -f "+flag+"\"\n")
+	if err := ioutil.WriteFile(dest, []byte("foo = new"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := tr.loadState()
+	if err != nil || s == nil || s.Error == "" || s.ExitStatus != 1 {
+		t.Fatalf("Expected the failed reload to be recorded, got %+v, %v", s, err)
+	}
+	if ok, _ := tr.reloaded(); ok {
+		t.Error("Expected a failed reload not to count as reloaded")
+	}
+
+	os.Remove(flag)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ok, err := tr.reloaded(); !ok || err != nil {
+		t.Errorf("Expected the reload to be run again and recorded, got %v", err)
+	}
+}
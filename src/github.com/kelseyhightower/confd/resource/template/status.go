@@ -0,0 +1,293 @@
+package template
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// ErrUnknownResource is returned when a template resource is requested by a
+// name that is not loaded.
+var ErrUnknownResource = errors.New("unknown template resource")
+
+// Outcome describes the result of processing a template resource.
+type Outcome string
+
+const (
+	// OutcomeUnchanged means the dest was already up to date.
+	OutcomeUnchanged Outcome = "unchanged"
+	// OutcomeUpdated means the dest was updated.
+	OutcomeUpdated Outcome = "updated"
+	// OutcomeCheckFailed means the check command rejected the new config.
+	OutcomeCheckFailed Outcome = "check_failed"
+	// OutcomeReloadFailed means the reload command failed.
+	OutcomeReloadFailed Outcome = "reload_failed"
+	// OutcomeVerifyFailed means the service could not be verified after the
+	// reload, and verify_fails_reload is set.
+	OutcomeVerifyFailed Outcome = "verify_failed"
+	// OutcomeHeld means the dest was left alone because confd rollback
+	// holds it.
+	OutcomeHeld Outcome = "held"
+	// OutcomeRejected means the dest was left alone because it was rolled
+	// back after being rendered from the same values.
+	OutcomeRejected Outcome = "rejected"
+	// OutcomeError means the config could not be rendered, for example
+	// because the backend was unreachable.
+	OutcomeError Outcome = "error"
+)
+
+// TriggerResult is the outcome of processing a template resource on demand.
+type TriggerResult struct {
+	Name    string  `json:"name"`
+	Outcome Outcome `json:"outcome"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// ResourceStatus reports the outcome of the most recent processing of a
+// template resource.
+type ResourceStatus struct {
+	Name           string    `json:"name"`
+	Dest           string    `json:"dest"`
+	Held           bool      `json:"held,omitempty"`
+	LastRender     time.Time `json:"last_render"`
+	LastOutcome    Outcome   `json:"last_outcome,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	BackendError   string    `json:"backend_error,omitempty"`
+	DestHash       string    `json:"dest_hash,omitempty"`
+	LastReload     time.Time `json:"last_reload"`
+	ReloadResult   string    `json:"reload_result,omitempty"`
+	ReloadExitCode int       `json:"reload_exit_code"`
+	// PendingUntil is when the render put off by debounce, or the reload
+	// put off by min_reload_interval, is due, or zero.
+	PendingUntil   time.Time `json:"pending_until"`
+	LastVerify     time.Time `json:"last_verify"`
+	VerifyResult   string    `json:"verify_result,omitempty"`
+	LastRollback   time.Time `json:"last_rollback"`
+	RollbackCause  string    `json:"rollback_cause,omitempty"`
+	RollbackResult string    `json:"rollback_result,omitempty"`
+}
+
+// Status returns the current status of t.
+func (t *TemplateResource) Status() ResourceStatus {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	s := t.status
+	s.Name = t.name
+	s.Dest = t.Dest
+	s.Held = t.isHeld()
+	return s
+}
+
+// setBackendError records the outcome of the latest call to the backend.
+func (t *TemplateResource) setBackendError(err error) {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status.BackendError = errorString(err)
+}
+
+// recordRender records the outcome of processing t.
+func (t *TemplateResource) recordRender(err error) {
+	var hash string
+	if err == nil {
+		if fi, ferr := fileStat(t.Dest); ferr == nil {
+			hash = fi.Md5
+		}
+	}
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status.LastOutcome = t.outcome
+	t.status.LastError = errorString(err)
+	if err == nil {
+		t.status.LastRender = time.Now()
+		t.status.DestHash = hash
+	}
+}
+
+// recordReload records the outcome of running the reload command.
+func (t *TemplateResource) recordReload(err error) {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status.LastReload = time.Now()
+	t.status.ReloadExitCode = exitCode(err)
+	if err != nil {
+		t.status.ReloadResult = err.Error()
+	} else {
+		t.status.ReloadResult = "ok"
+	}
+}
+
+// recordPending records that t is due to be processed at, or zero if
+// nothing is pending.
+func (t *TemplateResource) recordPending(at time.Time) {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status.PendingUntil = at
+}
+
+// recordVerify records the outcome of verifying the service after a reload.
+func (t *TemplateResource) recordVerify(err error) {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status.LastVerify = time.Now()
+	if err != nil {
+		t.status.VerifyResult = err.Error()
+	} else {
+		t.status.VerifyResult = "ok"
+	}
+}
+
+// recordRollback records the outcome of rolling back a dest rejected with
+// cause.
+func (t *TemplateResource) recordRollback(cause, err error) {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status.LastRollback = time.Now()
+	t.status.RollbackCause = errorString(cause)
+	if err != nil {
+		t.status.RollbackResult = err.Error()
+	} else {
+		t.status.RollbackResult = "ok"
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// exitCode returns the exit code of a command that finished with err, or -1
+// if the command did not run to completion.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok {
+			return ws.ExitStatus()
+		}
+	}
+	return -1
+}
+
+// resourceName returns the name of the template resource loaded from path:
+// its path relative to configDir without the .toml extension.
+func resourceName(configDir, path string) string {
+	name := filepath.Base(path)
+	if configDir != "" {
+		if rel, err := filepath.Rel(configDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// resourceSet holds the template resources of a processor so that their
+// status can be reported while the processor runs.
+type resourceSet struct {
+	// concurrency is the number of resources Trigger processes at once.
+	concurrency int
+	mutex       sync.RWMutex
+	resources   []*TemplateResource
+}
+
+// update replaces the resources with ts, keeping the loaded instance of every
+// resource whose definition did not change so that its status and watch index
+// survive. It returns the resources that were added and removed; a changed
+// resource is both removed and added.
+func (s *resourceSet) update(ts []*TemplateResource) (added, removed []*TemplateResource) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current := make(map[string]*TemplateResource, len(s.resources))
+	for _, t := range s.resources {
+		current[t.name] = t
+	}
+	resources := make([]*TemplateResource, 0, len(ts))
+	for _, t := range ts {
+		if old, ok := current[t.name]; ok && old.fingerprint == t.fingerprint {
+			resources = append(resources, old)
+			delete(current, t.name)
+			continue
+		}
+		resources = append(resources, t)
+		added = append(added, t)
+	}
+	for _, t := range s.resources {
+		if _, ok := current[t.name]; ok {
+			removed = append(removed, t)
+		}
+	}
+	s.resources = resources
+	return added, removed
+}
+
+// list returns the current resources.
+func (s *resourceSet) list() []*TemplateResource {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.resources
+}
+
+// Trigger processes the named template resource, or every resource if name
+// is empty, and returns the outcome for each of them.
+func (s *resourceSet) Trigger(name string) ([]TriggerResult, error) {
+	s.mutex.RLock()
+	var ts []*TemplateResource
+	for _, t := range s.resources {
+		if name == "" || t.name == name {
+			ts = append(ts, t)
+		}
+	}
+	s.mutex.RUnlock()
+	if name != "" && len(ts) == 0 {
+		return nil, ErrUnknownResource
+	}
+	for _, t := range ts {
+		log.Info("Processing " + t.name + " on demand")
+		t.retryRejected()
+	}
+	errs := processPass(ts, s.concurrency)
+	results := make([]TriggerResult, 0, len(ts))
+	for i, t := range ts {
+		if errs[i] != nil {
+			log.Error(errs[i].Error())
+		}
+		results = append(results, TriggerResult{Name: t.name, Outcome: t.Status().LastOutcome, Error: errorString(errs[i])})
+	}
+	return results, nil
+}
+
+// Status returns the status of every template resource.
+func (s *resourceSet) Status() []ResourceStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	statuses := make([]ResourceStatus, 0, len(s.resources))
+	for _, t := range s.resources {
+		statuses = append(statuses, t.Status())
+	}
+	return statuses
+}
+
+// drain prevents the resources from being processed again, waits for the
+// processing in progress to finish and removes leftover stage files.
+func (s *resourceSet) drain() {
+	closeAll(s.list())
+	s.RemoveStageFiles()
+}
+
+// RemoveStageFiles removes the stage files of every resource left behind by
+// processing that was interrupted.
+func (s *resourceSet) RemoveStageFiles() {
+	for _, t := range s.list() {
+		if err := t.removeStageFiles(); err != nil {
+			log.Error("Cannot remove stage files of " + t.Dest + ": " + err.Error())
+		}
+	}
+}
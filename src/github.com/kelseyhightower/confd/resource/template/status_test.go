@@ -0,0 +1,157 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/kelseyhightower/confd/backends/env"
+	"github.com/kelseyhightower/confd/log"
+)
+
+func TestExitCode(t *testing.T) {
+	if code := exitCode(nil); code != 0 {
+		t.Errorf("exitCode(nil) = %d, want 0", code)
+	}
+	err := exec.Command("/bin/sh", "-c", "exit 3").Run()
+	if code := exitCode(err); code != 3 {
+		t.Errorf("exitCode(exit 3) = %d, want 3", code)
+	}
+	err = exec.Command("/nonexistent/command").Run()
+	if code := exitCode(err); code != -1 {
+		t.Errorf("exitCode(missing command) = %d, want -1", code)
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	tests := []struct {
+		configDir, path, want string
+	}{
+		{"/etc/confd/conf.d", "/etc/confd/conf.d/nginx.toml", "nginx"},
+		{"/etc/confd/conf.d", "/etc/confd/conf.d/sites/app.toml", "sites/app"},
+		{"", "test/confd/config.toml", "config"},
+	}
+	for _, tt := range tests {
+		if got := resourceName(tt.configDir, tt.path); got != tt.want {
+			t.Errorf("resourceName(%q, %q) = %q, want %q", tt.configDir, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	log.SetLevel("warn")
+	tempConfDir, err := createTempDirs()
+	if err != nil {
+		t.Fatalf("Failed to create temp dirs: %s", err.Error())
+	}
+	defer os.RemoveAll(tempConfDir)
+	dest := filepath.Join(tempConfDir, "foo.conf")
+	err = ioutil.WriteFile(filepath.Join(tempConfDir, "templates", "foo.tmpl"), []byte(`foo = {{getv "/trigger/foo"}}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resource := "[template]\nsrc = \"foo.tmpl\"\ndest = \"" + dest + "\"\nkeys = [\"/trigger/foo\"]\ncheck_cmd = \"grep -v rejected {{.src}}\"\n"
+	err = ioutil.WriteFile(filepath.Join(tempConfDir, "conf.d", "foo.toml"), []byte(resource), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts, err := getTemplateResources(Config{
+		ConfDir:     tempConfDir,
+		ConfigDir:   filepath.Join(tempConfDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(tempConfDir, "templates"),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var s resourceSet
+	s.update(ts)
+
+	defer os.Unsetenv("TRIGGER_FOO")
+	tests := []struct {
+		value string
+		want  Outcome
+	}{
+		{"bar", OutcomeUpdated},
+		{"bar", OutcomeUnchanged},
+		{"baz", OutcomeUpdated},
+		{"rejected", OutcomeCheckFailed},
+	}
+	for _, tt := range tests {
+		os.Setenv("TRIGGER_FOO", tt.value)
+		results, err := s.Trigger("foo")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(results) != 1 || results[0].Name != "foo" || results[0].Outcome != tt.want {
+			t.Errorf("Trigger(foo) with %s = %+v, want %s", tt.value, results, tt.want)
+		}
+	}
+	if status := s.Status()[0]; status.LastOutcome != OutcomeCheckFailed {
+		t.Errorf("Expected last outcome %s, got %s", OutcomeCheckFailed, status.LastOutcome)
+	}
+	if _, err := s.Trigger("missing"); err != ErrUnknownResource {
+		t.Errorf("Trigger(missing) = %v, want %v", err, ErrUnknownResource)
+	}
+	results, err := s.Trigger("")
+	if err != nil || len(results) != 1 {
+		t.Errorf("Trigger() = %+v, %v", results, err)
+	}
+}
+
+func TestTriggerConcurrency(t *testing.T) {
+	log.SetLevel("warn")
+	tempConfDir, err := createTempDirs()
+	if err != nil {
+		t.Fatalf("Failed to create temp dirs: %s", err.Error())
+	}
+	defer os.RemoveAll(tempConfDir)
+	err = ioutil.WriteFile(filepath.Join(tempConfDir, "templates", "foo.tmpl"), []byte("foo"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Each check command waits for the other one to start, so both pass
+	// only if they run at once.
+	for _, name := range []string{"a", "b"} {
+		other := "b"
+		if name == "b" {
+			other = "a"
+		}
+		check := "touch " + filepath.Join(tempConfDir, name) + "; for i in $(seq 50); do [ -e " + filepath.Join(tempConfDir, other) + " ] && exit 0; sleep 0.1; done; exit 1"
+		resource := "[template]\nsrc = \"foo.tmpl\"\ndest = \"" + filepath.Join(tempConfDir, name+".conf") + "\"\nkeys = [\"/foo\"]\ncheck_cmd = \"" + check + "\"\n"
+		err = ioutil.WriteFile(filepath.Join(tempConfDir, "conf.d", name+".toml"), []byte(resource), 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts, err := getTemplateResources(Config{
+		ConfDir:     tempConfDir,
+		ConfigDir:   filepath.Join(tempConfDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(tempConfDir, "templates"),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := resourceSet{concurrency: 2}
+	s.update(ts)
+	results, err := s.Trigger("")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, r := range results {
+		if r.Outcome != OutcomeUpdated {
+			t.Errorf("Trigger() = %+v, want both resources updated", results)
+		}
+	}
+}
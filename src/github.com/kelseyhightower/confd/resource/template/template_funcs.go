@@ -22,9 +22,16 @@ func newFuncMap() map[string]interface{} {
 	m["toLower"] = strings.ToLower
 	m["contains"] = strings.Contains
 	m["replace"] = strings.Replace
+	m["shellquote"] = shellQuote
 	return m
 }
 
+// shellQuote returns s quoted for the shell: in single quotes, each single
+// quote it contains closing the quotes, escaped, and opening them again.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 func addFuncs(out, in map[string]interface{}) {
 	for name, fn := range in {
 		out[name] = fn
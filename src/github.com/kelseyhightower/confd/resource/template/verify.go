@@ -0,0 +1,125 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/kelseyhightower/confd/log"
+)
+
+// verifyHTTPRetryInterval is the time between attempts of a verify HTTP
+// request.
+var verifyHTTPRetryInterval = time.Second
+
+// Defaults of VerifyHTTP.
+const (
+	defaultVerifyHTTPStatus  = http.StatusOK
+	defaultVerifyHTTPTimeout = 5
+	defaultVerifyHTTPRetries = 3
+)
+
+// VerifyHTTP is an HTTP GET request that must be answered with Status
+// after the reload command.
+type VerifyHTTP struct {
+	URL    string `toml:"url"`
+	Status int    `toml:"status"`
+	// Timeout is the number of seconds to wait for an answer.
+	Timeout int `toml:"timeout"`
+	// Retries is how many times a failed request is retried.
+	Retries int `toml:"retries"`
+}
+
+// setDefaults fills in the settings of v left out of the template resource
+// decoded with md.
+// It returns an error if v is invalid.
+func (v *VerifyHTTP) setDefaults(md toml.MetaData) error {
+	if v.URL == "" {
+		return errors.New("verify_http requires a url")
+	}
+	if v.Status == 0 {
+		v.Status = defaultVerifyHTTPStatus
+	}
+	if v.Timeout == 0 {
+		v.Timeout = defaultVerifyHTTPTimeout
+	}
+	if !md.IsDefined("template", "verify_http", "retries") {
+		v.Retries = defaultVerifyHTTPRetries
+	}
+	if v.Timeout < 0 || v.Retries < 0 {
+		return errors.New("verify_http timeout and retries must not be negative")
+	}
+	return nil
+}
+
+// get sends the request of v with client.
+// It returns an error if it was not answered with the expected status.
+func (v *VerifyHTTP) get(client *http.Client) error {
+	resp, err := client.Get(v.URL)
+	if err != nil {
+		return err
+	}
+	// Drain the body so that the connection can be reused by a retry.
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != v.Status {
+		return fmt.Errorf("%s answered %s, expected %d", v.URL, resp.Status, v.Status)
+	}
+	return nil
+}
+
+// verifies reports whether the service of t is verified after a reload.
+func (t *TemplateResource) verifies() bool {
+	return t.VerifyCmd != "" || t.VerifyHTTP != nil
+}
+
+// verify runs the verify command and then the verify HTTP request, if set,
+// and records the outcome in the status of t.
+// It returns an error if either failed.
+func (t *TemplateResource) verify() error {
+	var err error
+	if t.VerifyCmd != "" {
+		err = t.verifyCmd()
+	}
+	if err == nil && t.VerifyHTTP != nil {
+		err = t.verifyHTTP()
+	}
+	t.recordVerify(err)
+	return err
+}
+
+// verifyCmd executes the verify command.
+// It returns nil if the verify command returns 0.
+func (t *TemplateResource) verifyCmd() error {
+	log.Debug("Running " + t.VerifyCmd)
+	output, err := run(t.shellCommand(t.VerifyCmd, t.reloadCtx), time.Duration(t.ReloadTimeout)*time.Second)
+	if err != nil {
+		log.Error(fmt.Sprintf("%q", string(output)))
+		return fmt.Errorf("verify command failed: %s", err.Error())
+	}
+	log.Debug(fmt.Sprintf("%q", string(output)))
+	return nil
+}
+
+// verifyHTTP sends the verify HTTP request, retrying it while it fails.
+// It returns the error of the last attempt if all of them failed.
+func (t *TemplateResource) verifyHTTP() error {
+	v := t.VerifyHTTP
+	client := &http.Client{Timeout: time.Duration(v.Timeout) * time.Second}
+	log.Debug("Requesting " + v.URL)
+	err := v.get(client)
+	for i := 0; err != nil && i < v.Retries; i++ {
+		log.Debug(fmt.Sprintf("Retrying %s (%d/%d): %s", v.URL, i+1, v.Retries, err.Error()))
+		select {
+		case <-t.context().Done():
+			return err
+		case <-time.After(verifyHTTPRetryInterval):
+		}
+		err = v.get(client)
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package template
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// flakyServer answers 503 to the first failures requests and 200 to the
+// others.
+func flakyServer(failures int) *httptest.Server {
+	var mutex sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+func TestVerifyHTTP(t *testing.T) {
+	log.SetLevel("error")
+	defer func(d time.Duration) { verifyHTTPRetryInterval = d }(verifyHTTPRetryInterval)
+	verifyHTTPRetryInterval = 10 * time.Millisecond
+	os.Setenv("ROLLBACK_FOO", "new")
+	defer os.Unsetenv("ROLLBACK_FOO")
+	tests := []struct {
+		failures int
+		policy   string
+		outcome  Outcome
+		rendered bool
+		verified bool
+	}{
+		{2, "", OutcomeUpdated, true, true},
+		{5, "", OutcomeUpdated, true, false},
+		{5, "verify_fails_reload = true\n", OutcomeVerifyFailed, false, false},
+	}
+	for _, tt := range tests {
+		confDir, err := createTempDirs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(confDir)
+		server := flakyServer(tt.failures)
+		defer server.Close()
+		dest := filepath.Join(confDir, "foo.conf")
+		tr := newRollbackResource(t, confDir, dest, "reload_cmd = \"true\"\n"+tt.policy+
+			"[template.verify_http]\nurl = \""+server.URL+"\"\nretries = 2\n")
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		s := tr.Status()
+		if s.LastOutcome != tt.outcome {
+			t.Errorf("%d failures, %q: expected outcome %s, got %s", tt.failures, tt.policy, tt.outcome, s.LastOutcome)
+		}
+		if isFileExist(dest) != tt.rendered {
+			t.Errorf("%d failures, %q: expected dest to be rendered: %t", tt.failures, tt.policy, tt.rendered)
+		}
+		if (s.VerifyResult == "ok") != tt.verified || s.LastVerify.IsZero() {
+			t.Errorf("%d failures, %q: expected verified %t, got %q", tt.failures, tt.policy, tt.verified, s.VerifyResult)
+		}
+		if !tt.verified && !strings.Contains(s.VerifyResult, "503") {
+			t.Errorf("Expected the verify result to report the status, got %q", s.VerifyResult)
+		}
+	}
+}
+
+func TestNewTemplateResourceVerifyHTTP(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	dest := filepath.Join(confDir, "foo.conf")
+	tr := newRollbackResource(t, confDir, dest, "[template.verify_http]\nurl = \"http://127.0.0.1:8080/status\"\n")
+	want := VerifyHTTP{URL: "http://127.0.0.1:8080/status", Status: 200, Timeout: 5, Retries: 3}
+	if tr.VerifyHTTP == nil || *tr.VerifyHTTP != want {
+		t.Errorf("Expected %+v, got %+v", want, tr.VerifyHTTP)
+	}
+	if tr.VerifyFailsReload {
+		t.Error("Expected a failed verification not to count as a failed reload by default")
+	}
+}
@@ -0,0 +1,234 @@
+package template
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/confd/backends"
+	"github.com/kelseyhightower/confd/log"
+)
+
+// bucketRecreatePollInterval is how often a deleted bucket is checked for
+// being recreated.
+var bucketRecreatePollInterval = 10 * time.Second
+
+// watchEvent is the result of a backend watch: the prefix changed, or the
+// watch failed with err.
+type watchEvent struct {
+	err error
+}
+
+// watchMux keeps one backend watch per distinct prefix and delivers its
+// events to every template resource subscribed to that prefix. A watch is
+// started with its first subscriber and stopped with its last. Failed
+// watches are reported on errChan once per prefix.
+type watchMux struct {
+	storeClient backends.StoreClient
+	backend     string
+	errChan     chan error
+	mutex       sync.Mutex
+	watches     map[string]*prefixWatch
+}
+
+// prefixWatch is the backend watch of a prefix and its subscribers.
+type prefixWatch struct {
+	prefix      string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	subscribers map[*TemplateResource]*subscription
+	// ready is true once the prefix was read successfully, so that new
+	// subscribers can be rendered right away.
+	ready bool
+}
+
+// subscription holds the events of a prefix not yet received by a
+// subscriber. Events are coalesced so that publishing never blocks: a
+// deleted prefix makes the events before it moot, and a change or an
+// error replaces the pending one of the same kind. An error is never
+// dropped in favor of a change.
+type subscription struct {
+	// ready receives a value whenever events are pending.
+	ready   chan bool
+	mutex   sync.Mutex
+	pending []watchEvent
+}
+
+func newSubscription() *subscription {
+	return &subscription{ready: make(chan bool, 1)}
+}
+
+// add queues e.
+func (s *subscription) add(e watchEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if backends.IsPrefixDeleted(e.err) {
+		s.pending = []watchEvent{e}
+	} else {
+		pending := s.pending[:0]
+		for _, p := range s.pending {
+			if (p.err == nil) != (e.err == nil) || backends.IsPrefixDeleted(p.err) {
+				pending = append(pending, p)
+			}
+		}
+		s.pending = append(pending, e)
+	}
+	notify(s.ready)
+}
+
+// next returns the oldest pending event, if any.
+func (s *subscription) next() (watchEvent, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.pending) == 0 {
+		return watchEvent{}, false
+	}
+	e := s.pending[0]
+	s.pending = s.pending[1:]
+	if len(s.pending) > 0 {
+		notify(s.ready)
+	}
+	return e, true
+}
+
+func newWatchMux(config Config, errChan chan error) *watchMux {
+	return &watchMux{
+		storeClient: config.StoreClient,
+		backend:     config.Backend,
+		errChan:     errChan,
+		watches:     make(map[string]*prefixWatch),
+	}
+}
+
+// subscribe returns the subscription of t to the events of its prefix,
+// starting a watch if there is none yet.
+func (m *watchMux) subscribe(t *TemplateResource) *subscription {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	w, ok := m.watches[t.prefix]
+	if !ok {
+		w = &prefixWatch{
+			prefix:      t.prefix,
+			subscribers: make(map[*TemplateResource]*subscription),
+		}
+		w.ctx, w.cancel = context.WithCancel(context.Background())
+		m.watches[t.prefix] = w
+		go m.watch(w)
+	}
+	s := newSubscription()
+	w.subscribers[t] = s
+	if w.ready {
+		s.add(watchEvent{})
+	}
+	return s
+}
+
+// unsubscribe stops delivering events to t, and stops the watch of its
+// prefix if t was the last subscriber.
+func (m *watchMux) unsubscribe(t *TemplateResource) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	w, ok := m.watches[t.prefix]
+	if !ok {
+		return
+	}
+	delete(w.subscribers, t)
+	if len(w.subscribers) == 0 {
+		w.cancel()
+		delete(m.watches, t.prefix)
+	}
+}
+
+// publish delivers e to every subscriber of w, and reports its error once.
+func (m *watchMux) publish(w *prefixWatch, e watchEvent) {
+	m.mutex.Lock()
+	w.ready = e.err == nil
+	for _, s := range w.subscribers {
+		s.add(e)
+	}
+	m.mutex.Unlock()
+	if e.err == nil {
+		return
+	}
+	select {
+	case m.errChan <- fmt.Errorf("%s: %s", w.prefix, e.err.Error()):
+	case <-w.ctx.Done():
+	}
+}
+
+// watch watches the prefix of w until w is canceled.
+func (m *watchMux) watch(w *prefixWatch) {
+	watchedPrefixes.WithLabelValues(m.backend).Inc()
+	defer watchedPrefixes.WithLabelValues(m.backend).Dec()
+	defer m.stopped(w)
+	var index uint64
+	for {
+		next, err := m.watchPrefix(w, index)
+		select {
+		case <-w.ctx.Done():
+			return
+		default:
+		}
+		switch {
+		case err == nil:
+			index = next
+		case backends.IsPrefixDeleted(err):
+			m.publish(w, watchEvent{err: err})
+			var ok bool
+			if index, ok = m.waitForBucket(w); !ok {
+				return
+			}
+		default:
+			m.publish(w, watchEvent{err: err})
+			// Prevent backend errors from consuming all resources.
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-time.After(2 * time.Second):
+			}
+			continue
+		}
+		m.publish(w, watchEvent{})
+	}
+}
+
+// watchPrefix watches the prefix of w from index and records the call.
+// Watches are shared by the template resources of a prefix, so they are
+// recorded against the prefix.
+func (m *watchMux) watchPrefix(w *prefixWatch, index uint64) (uint64, error) {
+	start := time.Now()
+	next, err := m.storeClient.WatchPrefix(w.ctx, w.prefix, index)
+	observeWatch(w.ctx, w.prefix, m.backend, start, err)
+	return next, err
+}
+
+// stopped drops the metrics of the watch of w once it returns, unless the
+// prefix is watched again already.
+func (m *watchMux) stopped(w *prefixWatch) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.watches[w.prefix]; !ok {
+		deleteWatchMetrics(w.prefix, m.backend)
+	}
+}
+
+// waitForBucket waits for the deleted prefix of w to be recreated and
+// returns the index to resume watching from. It returns false if w was
+// canceled first.
+func (m *watchMux) waitForBucket(w *prefixWatch) (uint64, bool) {
+	for {
+		select {
+		case <-w.ctx.Done():
+			return 0, false
+		case <-time.After(bucketRecreatePollInterval):
+		}
+		index, err := m.watchPrefix(w, 0)
+		if err != nil {
+			log.Debug("Bucket for " + w.prefix + " not recreated yet: " + err.Error())
+			continue
+		}
+		log.Info("Bucket for " + w.prefix + " was recreated, resuming watch")
+		return index, true
+	}
+}
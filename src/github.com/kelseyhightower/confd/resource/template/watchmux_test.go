@@ -0,0 +1,232 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// fakeWatchClient returns from WatchPrefix when a prefix is changed or
+// fails, and counts the watches in progress.
+type fakeWatchClient struct {
+	mutex    sync.Mutex
+	active   map[string]int
+	changes  map[string]chan bool
+	failures map[string]chan error
+}
+
+func newFakeWatchClient() *fakeWatchClient {
+	return &fakeWatchClient{
+		active:   make(map[string]int),
+		changes:  make(map[string]chan bool),
+		failures: make(map[string]chan error),
+	}
+}
+
+func (c *fakeWatchClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (c *fakeWatchClient) WatchPrefix(ctx context.Context, prefix string, waitIndex uint64) (uint64, error) {
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	c.mutex.Lock()
+	c.active[prefix]++
+	changes, failures := c.channels(prefix)
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.active[prefix]--
+		c.mutex.Unlock()
+	}()
+	select {
+	case <-changes:
+		return waitIndex + 1, nil
+	case err := <-failures:
+		return waitIndex, err
+	case <-ctx.Done():
+		return waitIndex, ctx.Err()
+	}
+}
+
+func (c *fakeWatchClient) Health(ctx context.Context) error {
+	return nil
+}
+
+func (c *fakeWatchClient) Close() error {
+	return nil
+}
+
+// waitForWatches waits until n watches of prefix are in progress.
+func (c *fakeWatchClient) waitForWatches(t *testing.T, prefix string, n int) {
+	for i := 0; i < 100; i++ {
+		c.mutex.Lock()
+		active := c.active[prefix]
+		c.mutex.Unlock()
+		if active == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d watches of %s", n, prefix)
+}
+
+// channels returns the channels on which the changes and failures of the
+// watches of prefix are sent. c.mutex must be held.
+func (c *fakeWatchClient) channels(prefix string) (chan bool, chan error) {
+	if _, ok := c.changes[prefix]; !ok {
+		c.changes[prefix] = make(chan bool)
+		c.failures[prefix] = make(chan error)
+	}
+	return c.changes[prefix], c.failures[prefix]
+}
+
+// change changes prefix, which must be watched.
+func (c *fakeWatchClient) change(prefix string) {
+	c.mutex.Lock()
+	changes, _ := c.channels(prefix)
+	c.mutex.Unlock()
+	changes <- true
+}
+
+func (c *fakeWatchClient) fail(prefix string, err error) {
+	c.mutex.Lock()
+	_, failures := c.channels(prefix)
+	c.mutex.Unlock()
+	failures <- err
+}
+
+func expectEvent(t *testing.T, events *subscription, name string) {
+	select {
+	case <-events.ready:
+		e, ok := events.next()
+		if !ok {
+			t.Fatalf("Expected a pending event for %s", name)
+		}
+		if e.err != nil {
+			t.Errorf("Unexpected error for %s: %s", name, e.err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an event for %s", name)
+	}
+}
+
+func TestWatchMux(t *testing.T) {
+	log.SetLevel("warn")
+	client := newFakeWatchClient()
+	m := newWatchMux(Config{StoreClient: client, Backend: "fake"}, make(chan error, 10))
+	a := &TemplateResource{name: "a", prefix: "/app"}
+	b := &TemplateResource{name: "b", prefix: "/app"}
+	c := &TemplateResource{name: "c", prefix: "/other"}
+
+	aEvents := m.subscribe(a)
+	expectEvent(t, aEvents, "a")
+	client.waitForWatches(t, "/app", 1)
+
+	// A new subscriber shares the watch and is rendered right away.
+	bEvents := m.subscribe(b)
+	expectEvent(t, bEvents, "b")
+	cEvents := m.subscribe(c)
+	expectEvent(t, cEvents, "c")
+	client.waitForWatches(t, "/app", 1)
+	client.waitForWatches(t, "/other", 1)
+
+	client.change("/app")
+	expectEvent(t, aEvents, "a")
+	expectEvent(t, bEvents, "b")
+	select {
+	case <-cEvents.ready:
+		t.Error("Unexpected event for c")
+	default:
+	}
+
+	// The watch lives as long as it has subscribers.
+	m.unsubscribe(a)
+	client.change("/app")
+	expectEvent(t, bEvents, "b")
+	client.waitForWatches(t, "/app", 1)
+	m.unsubscribe(b)
+	client.waitForWatches(t, "/app", 0)
+	client.waitForWatches(t, "/other", 1)
+	m.unsubscribe(c)
+	client.waitForWatches(t, "/other", 0)
+}
+
+type prefixDeletedError struct{}
+
+func (prefixDeletedError) Error() string       { return "deleted" }
+func (prefixDeletedError) PrefixDeleted() bool { return true }
+
+func TestSubscription(t *testing.T) {
+	s := newSubscription()
+	deleted := prefixDeletedError{}
+	first, second := errors.New("first"), errors.New("second")
+	for _, e := range []watchEvent{{}, {err: deleted}, {}, {}, {err: first}, {err: second}, {}} {
+		s.add(e)
+	}
+	// The change before the deletion is moot, and the latest change and
+	// error replace the earlier ones, but nothing drops the deletion.
+	var got []error
+	for {
+		select {
+		case <-s.ready:
+		default:
+			t.Fatalf("Expected ready to be signaled while events are pending, got %v", got)
+		}
+		e, ok := s.next()
+		if !ok {
+			t.Fatalf("Expected a pending event, got %v", got)
+		}
+		got = append(got, e.err)
+		if len(s.pending) == 0 {
+			break
+		}
+	}
+	if want := []error{deleted, second, nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected events %v, got %v", want, got)
+	}
+}
+
+func TestWatchMuxErrors(t *testing.T) {
+	log.SetLevel("warn")
+	client := newFakeWatchClient()
+	errChan := make(chan error, 10)
+	m := newWatchMux(Config{StoreClient: client, Backend: "fake"}, errChan)
+	a := &TemplateResource{name: "a", prefix: "/app"}
+	b := &TemplateResource{name: "b", prefix: "/app"}
+	aEvents := m.subscribe(a)
+	expectEvent(t, aEvents, "a")
+	client.waitForWatches(t, "/app", 1)
+	bEvents := m.subscribe(b)
+	expectEvent(t, bEvents, "b")
+	defer m.unsubscribe(a)
+	defer m.unsubscribe(b)
+
+	client.fail("/app", errors.New("unreachable"))
+	for _, events := range []*subscription{aEvents, bEvents} {
+		select {
+		case <-events.ready:
+			if e, _ := events.next(); e.err == nil {
+				t.Error("Expected the error to be delivered to every subscriber")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected an error event")
+		}
+	}
+	// The error is reported once for the prefix.
+	if err := <-errChan; !strings.Contains(err.Error(), "/app") {
+		t.Errorf("Expected the error to name the prefix, got %v", err)
+	}
+	select {
+	case err := <-errChan:
+		t.Errorf("Expected the error to be reported once, got %v again", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}